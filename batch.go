@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Limits keeping batch requests well below the Sheets API payload and URL sizes
+var (
+	batchReadMaxRanges = 100
+	batchWriteMaxCells = 10000
+)
+
+// writeBatch queues the cell writes of a sync run, to be sent with as few
+// batchUpdate requests as possible
+type writeBatch struct {
+	ranges []CellRange
+	titles []string // The KPI or datapoint title of each range
+}
+
+// add queues values to be set in a cell range for a KPI or datapoint
+func (b *writeBatch) add(title, cellRange string, values [][]interface{}) {
+	b.ranges = append(b.ranges, CellRange{Range: cellRange, Values: values})
+	b.titles = append(b.titles, title)
+}
+
+// flush writes the queued ranges in chunks of at most batchWriteMaxCells
+// cells, and returns the error per title for the chunks that failed
+func (b *writeBatch) flush(sink Sink) map[string]error {
+	failed := make(map[string]error)
+	write := func(start, end int) {
+		if err := sink.BatchWrite(b.ranges[start:end]); err != nil {
+			for _, title := range b.titles[start:end] {
+				failed[title] = fmt.Errorf("update %d cell range(s): %w", end-start, err)
+			}
+		}
+	}
+
+	start, cells := 0, 0
+	for i, r := range b.ranges {
+		n := 0
+		for _, row := range r.Values {
+			n += len(row)
+		}
+		if i > start && cells+n > batchWriteMaxCells {
+			write(start, i)
+			start, cells = i, 0
+		}
+		cells += n
+	}
+	if start < len(b.ranges) {
+		write(start, len(b.ranges))
+	}
+	b.ranges, b.titles = nil, nil
+	return failed
+}
+
+// readRanges reads cell ranges in chunks of at most batchReadMaxRanges,
+// and returns the values in the order of the ranges
+func readRanges(sink Sink, cellRanges []string, unformatted bool) ([][][]interface{}, error) {
+	var values [][][]interface{}
+	for start := 0; start < len(cellRanges); start += batchReadMaxRanges {
+		end := start + batchReadMaxRanges
+		if end > len(cellRanges) {
+			end = len(cellRanges)
+		}
+		chunk, err := sink.BatchRead(cellRanges[start:end], unformatted)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, chunk...)
+	}
+	return values, nil
+}
+
+// firstValue returns the top left value of a cell range, or nil if empty
+func firstValue(values [][]interface{}) interface{} {
+	if len(values) > 0 && len(values[0]) > 0 {
+		return values[0][0]
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestWriteBatchFlushChunks(t *testing.T) {
+	defer func(n int) { batchWriteMaxCells = n }(batchWriteMaxCells)
+	batchWriteMaxCells = 4
+
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	batch := &writeBatch{}
+	batch.add("first", "Data!A1:B2", [][]interface{}{{1, 2}, {3, 4}})
+	batch.add("second", "Data!C1:C1", [][]interface{}{{5}})
+	batch.add("third", "Data!D1:D2", [][]interface{}{{6}, {7}})
+	batch.add("huge", "Data!E1:E5", [][]interface{}{{1}, {2}, {3}, {4}, {5}})
+	fake.failNext(http.MethodPost, 1, http.StatusBadRequest)
+
+	failed := batch.flush(fake.sink())
+
+	// The first chunk fails, the second holds two ranges and
+	// the range larger than a chunk is sent on its own
+	if got := fake.count(http.MethodPost); got != 3 {
+		t.Errorf("got %d batch updates, want 3", got)
+	}
+	if len(failed) != 1 || failed["first"] == nil {
+		t.Errorf("failed = %v, want only first", failed)
+	}
+	for cell, want := range map[string]interface{}{"A1": nil, "C1": 5.0, "D2": 7.0, "E5": 5.0} {
+		if got := fake.get("Data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
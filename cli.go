@@ -0,0 +1,549 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/takuoki/clmconv"
+)
+
+const usage = `Usage: kpi-uploader [command] [flags]
+
+Commands:
+  run          Sync the KPIs or datapoints once
+  plan         Like run, but only print the planned sheet changes
+  validate     Check the config file without connecting to the spreadsheet
+  list-topics  List the topics in the topic row and their columns
+  list-keys    List the keys in the key column and their rows
+  backfill     Sync the KPIs into the periods of earlier dates
+  serve        Run as a daemon, syncing on the configured schedules
+
+Without a command kpi-uploader runs as a daemon when a schedule is
+configured, and syncs once otherwise.
+
+Flags:
+`
+
+// yesNoFlags are the config fields which can be given as boolean flags,
+// i.e --dry-run sets dry-run to "yes"
+var yesNoFlags = map[string]bool{
+	"dry-run": true,
+}
+
+// configOverrides holds config values given on the command line, by YAML key
+type configOverrides map[string]string
+
+// configFlag is a flag overriding a single string field of Config
+type configFlag struct {
+	overrides configOverrides
+	key       string
+}
+
+func (f configFlag) String() string {
+	return f.overrides[f.key]
+}
+
+func (f configFlag) Set(value string) error {
+	if yesNoFlags[f.key] {
+		if b, err := strconv.ParseBool(value); err == nil {
+			value = "no"
+			if b {
+				value = "yes"
+			}
+		}
+	}
+	f.overrides[f.key] = value
+	return nil
+}
+
+func (f configFlag) IsBoolFlag() bool {
+	return yesNoFlags[f.key]
+}
+
+// addConfigFlags registers a flag for every string field of Config, named
+// after its YAML key, i.e --sheet-name
+func addConfigFlags(fs *flag.FlagSet, overrides configOverrides) {
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if field.Type.Kind() != reflect.String || key == "" {
+			continue
+		}
+		fs.Var(configFlag{overrides: overrides, key: key}, key,
+			"override "+key+" from the config file")
+	}
+}
+
+// apply sets the overridden fields in cfg
+func (o configOverrides) apply(cfg *Config) {
+	v := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")[0]
+		if value, ok := o[key]; ok {
+			v.Field(i).SetString(value)
+		}
+	}
+}
+
+// titleList is a repeatable flag collecting KPI or datapoint titles
+type titleList []string
+
+func (l *titleList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *titleList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// runCommand runs a kpi-uploader command and returns the exit code
+func runCommand(args []string) int {
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	fs := flag.NewFlagSet("kpi-uploader", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "config file, defaults to CONFIG_FILE or "+configYamlDefault)
+	secretFile := fs.String("secret", "", "service account secret, defaults to SECRET_FILE or "+clientSecretFileDefault)
+	overrides := configOverrides{}
+	addConfigFlags(fs, overrides)
+
+	var only titleList
+	var date, from, to string
+	switch command {
+	case "", "run", "plan":
+		fs.Var(&only, "only", "only sync the KPI or datapoint with this title, can be repeated")
+	case "backfill":
+		fs.Var(&only, "only", "only backfill the KPI with this title, can be repeated")
+		fs.StringVar(&date, "date", "", "a date (2006-01-02) within the period to backfill")
+		fs.StringVar(&from, "from", "", "a date (2006-01-02) within the first period to backfill")
+		fs.StringVar(&to, "to", "", "a date (2006-01-02) within the last period to backfill, defaults to --from")
+	case "validate", "list-topics", "list-keys", "serve":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		fs.Usage()
+		return 2
+	}
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments %q\n", fs.Args())
+		return 2
+	}
+
+	logit.Info("Starting up")
+
+	cfg := parseConfigYaml(*configFile)
+	overrides.apply(cfg)
+	if command == "plan" {
+		cfg.DryRun = "yes"
+	}
+	if err := cfg.only(only); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	problems := validateConfig(cfg)
+	for _, err := range problems {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if command == "validate" {
+		if len(problems) > 0 {
+			return 1
+		}
+		fmt.Println("Config OK")
+		return 0
+	}
+	if len(problems) > 0 {
+		return 2
+	}
+
+	// Echo main config parameters
+	logit.WithFields(log.Fields{
+		"spreadsheet-id":        cfg.SpreadsheetID,
+		"sheet-name":            cfg.SheetName,
+		"sheet-last-update-col": cfg.SheetLastUpdateCol,
+		"sheet-key-col":         cfg.SheetKeyCol,
+		"sheet-topic-row":       cfg.SheetTopicRow,
+		"sheet-data-start-row":  cfg.SheetDataStartRow,
+		"ckecks-port":           cfg.CkecksPort,
+		"checks-path-metrics":   cfg.ChecksPathMetrics,
+		"checks-path-ready":     cfg.ChecksPathReady,
+		"checks-path-live":      cfg.ChecksPathLive,
+		"checks-path-health":    cfg.ChecksPathHealth,
+		"health-max-staleness":  cfg.HealthMaxStaleness,
+		"schedule":              cfg.Schedule,
+		"dry-run":               cfg.DryRun,
+	}).Debug("Spreadsheet")
+
+	switch command {
+	case "list-topics", "list-keys":
+		sink := connectSink(cfg, *secretFile)
+		var err error
+		if command == "list-topics" {
+			err = listTopics(cfg, sink, os.Stdout)
+		} else {
+			err = listKeys(cfg, sink, os.Stdout)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	targets := []syncTarget{{At: time.Now()}}
+	switch command {
+	case "":
+		if isScheduled(cfg) {
+			command = "serve"
+		}
+	case "serve":
+		if !isScheduled(cfg) {
+			fmt.Fprintln(os.Stderr, "No schedule configured to serve")
+			return 2
+		}
+	case "backfill":
+		if cfg.KPI == nil {
+			fmt.Fprintln(os.Stderr, "Only KPIs can be backfilled")
+			return 2
+		}
+		if date != "" {
+			if from != "" || to != "" {
+				fmt.Fprintln(os.Stderr, "Use either --date or --from and --to")
+				return 2
+			}
+			from = date
+		}
+		periods, _ := newPeriodFormat(cfg) // Checked by validateConfig
+		var err error
+		if targets, err = backfillTargets(periods, from, to); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	maxStaleness, _ := time.ParseDuration(cfg.HealthMaxStaleness) // Checked by validateConfig
+	health.setConfigured(maxStaleness)
+
+	// go Serve(":8080", "/_/metrics", "/_/ready", "/_/alive", "/_/health", logit)
+	go Serve(cfg.CkecksPort, cfg.ChecksPathMetrics, cfg.ChecksPathReady,
+		cfg.ChecksPathLive, cfg.ChecksPathHealth, logit)
+
+	sink := connectSink(cfg, *secretFile)
+	if err := sink.Ping(); err != nil {
+		logit.WithFields(log.Fields{
+			"error":       err,
+			"spreadsheet": cfg.SpreadsheetID,
+		}).Error("Accessing spreadsheet")
+	} else {
+		health.setConnected()
+	}
+
+	if command == "serve" {
+		if err := runDaemon(cfg, sink); err != nil {
+			logit.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Running scheduler")
+		}
+		logit.Info("Shutting down")
+		return 0
+	}
+
+	failed := false
+	for _, target := range targets {
+		if summary := runSync(cfg, sink, target); summary.Failed() {
+			failed = true
+		}
+	}
+
+	logit.Info("Shutting down")
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// backfillTargets returns a backfill target per period from the one
+// holding the from date to the one holding the to date, oldest first
+func backfillTargets(periods *periodFormat, from, to string) ([]syncTarget, error) {
+	if to == "" {
+		to = from
+	}
+	first, err := time.ParseInLocation("2006-01-02", from, periods.location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --from %q, expected 2006-01-02", from)
+	}
+	last, err := time.ParseInLocation("2006-01-02", to, periods.location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --to %q, expected 2006-01-02", to)
+	}
+	if last.Before(first) {
+		return nil, fmt.Errorf("--to %s is before --from %s", to, from)
+	}
+
+	var targets []syncTarget
+	for at := periods.start(first); !at.After(last); at = periods.next(at) {
+		if len(targets) == maxPeriodLookback {
+			return nil, fmt.Errorf("more than %d periods from %s to %s", maxPeriodLookback, from, to)
+		}
+		targets = append(targets, syncTarget{At: at, Backfill: true})
+	}
+	return targets, nil
+}
+
+// connectSink connects to the configured Google spreadsheet
+func connectSink(cfg *Config, secretFile string) *googleSheetSink {
+	retry, _ := newRetryPolicy(cfg) // Checked by validateConfig
+	limiter, _ := newSheetsLimiter(cfg)
+	return newGoogleSheetSink(connectToGoogleSheet(secretFile, *cfg), cfg.SpreadsheetID, retry, limiter)
+}
+
+// only keeps the KPIs and datapoints with the given titles, if any
+func (cfg *Config) only(titles []string) error {
+	if len(titles) == 0 {
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, title := range titles {
+		wanted[title] = false
+	}
+
+	// Expressions need the KPIs they are computed from
+	keep := make(map[string]bool)
+	for title := range wanted {
+		keep[title] = true
+	}
+	for added := true; added; {
+		added = false
+		for _, kpi := range cfg.KPI {
+			if !keep[kpi.Title] {
+				continue
+			}
+			for _, ref := range expressionRefs(kpi.Expression) {
+				if !keep[ref] {
+					keep[ref], added = true, true
+				}
+			}
+		}
+	}
+
+	var kpis []KPIs
+	for _, kpi := range cfg.KPI {
+		if keep[kpi.Title] {
+			kpis = append(kpis, kpi)
+			wanted[kpi.Title] = true
+		}
+	}
+	var datapoints []Datapoint
+	for _, dp := range cfg.Datapoints {
+		if _, ok := wanted[dp.Title]; ok {
+			datapoints = append(datapoints, dp)
+			wanted[dp.Title] = true
+		}
+	}
+	for _, title := range titles {
+		if !wanted[title] {
+			return fmt.Errorf("no KPI or datapoint titled %q", title)
+		}
+	}
+
+	// The KPIs take precedence, so drop them when only datapoints are wanted
+	cfg.KPI = kpis
+	cfg.Datapoints = datapoints
+	return nil
+}
+
+// validateConfig returns the problems found in the config
+func validateConfig(cfg *Config) []error {
+	var problems []error
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Errorf(format, a...))
+	}
+
+	for _, required := range []struct{ key, value string }{
+		{"spreadsheet-id", cfg.SpreadsheetID},
+		{"sheet-name", cfg.SheetName},
+		{"sheet-key-col", cfg.SheetKeyCol},
+		{"sheet-topic-row", cfg.SheetTopicRow},
+	} {
+		if required.value == "" {
+			problem("%s is not set", required.key)
+		}
+	}
+	if _, err := strconv.Atoi(cfg.SheetTopicRow); cfg.SheetTopicRow != "" && err != nil {
+		problem("sheet-topic-row %q is not a row number", cfg.SheetTopicRow)
+	}
+	if _, err := strconv.Atoi(cfg.SheetDataStartRow); cfg.SheetDataStartRow != "" && err != nil {
+		problem("sheet-data-start-row %q is not a row number", cfg.SheetDataStartRow)
+	}
+	if cfg.HealthMaxStaleness != "" {
+		if _, err := time.ParseDuration(cfg.HealthMaxStaleness); err != nil {
+			problem("health-max-staleness %q: %v", cfg.HealthMaxStaleness, err)
+		}
+	}
+	if _, err := newRetryPolicy(cfg); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := newSheetsLimiter(cfg); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := newPeriodFormat(cfg); err != nil {
+		problems = append(problems, err)
+	}
+	if _, err := newKeyNormalizer(cfg); err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.DryRun != "" && cfg.DryRun != "yes" && cfg.DryRun != "no" {
+		problem("dry-run %q is not yes or no", cfg.DryRun)
+	}
+	if cfg.AddPeriodColumn != "" && cfg.AddPeriodColumn != "append" && cfg.AddPeriodColumn != "insert" {
+		problem("add-period-column %q is not append or insert", cfg.AddPeriodColumn)
+	}
+	if cfg.AddKPIRows != "" && cfg.AddKPIRows != "append" && cfg.AddKPIRows != "insert" {
+		problem("add-kpi-rows %q is not append or insert", cfg.AddKPIRows)
+	}
+	if cfg.PlanFormat != "" && cfg.PlanFormat != "text" && cfg.PlanFormat != "json" {
+		problem("plan-format %q is not text or json", cfg.PlanFormat)
+	}
+
+	checkSchedule := func(title, schedule string) {
+		if schedule == "" {
+			return
+		}
+		if _, err := cron.ParseStandard(schedule); err != nil {
+			problem("%s: invalid schedule %q: %v", title, schedule, err)
+		}
+	}
+	checkSchedule("schedule", cfg.Schedule)
+
+	if cfg.KPI == nil && cfg.Datapoints == nil {
+		problems = append(problems, errors.New("no KPI or datapoints to sync"))
+	}
+	for i, kpi := range cfg.KPI {
+		if kpi.Title == "" {
+			problem("KPI %d has no title", i+1)
+		}
+		if _, err := strconv.Atoi(kpi.SheetRow); kpi.SheetRow != "" && err != nil {
+			problem("KPI %q: sheet-row %q is not a row number", kpi.Title, kpi.SheetRow)
+		}
+		if err := validateKPIValue(&kpi); err != nil {
+			problem("KPI %q: %v", kpi.Title, err)
+		}
+		if err := kpi.JSONRequest.validate(); err != nil {
+			problem("KPI %q: json-request %v", kpi.Title, err)
+		}
+		if kpi.Prometheus != nil {
+			if err := kpi.Prometheus.validate(cfg.PrometheusURL, false); err != nil {
+				problem("KPI %q: %v", kpi.Title, err)
+			}
+		}
+		if kpi.SQL != nil {
+			if err := kpi.SQL.validate(); err != nil {
+				problem("KPI %q: %v", kpi.Title, err)
+			}
+		}
+		checkSchedule("KPI "+strconv.Quote(kpi.Title), kpi.Schedule)
+	}
+	_, expressionErrs := expressionOrder(cfg.KPI)
+	for _, kpi := range cfg.KPI {
+		if err := expressionErrs[kpi.Title]; err != nil {
+			problem("KPI %q: %v", kpi.Title, err)
+		}
+	}
+	for i, dp := range cfg.Datapoints {
+		if dp.Title == "" {
+			problem("datapoint %d has no title", i+1)
+		}
+		if !dp.hasSource() && dp.Cell == "" {
+			problem("datapoint %q has no command, prometheus, sql or cell", dp.Title)
+		}
+		if dp.Prometheus != nil {
+			if err := dp.Prometheus.validate(cfg.PrometheusURL, true); err != nil {
+				problem("datapoint %q: %v", dp.Title, err)
+			}
+		}
+		if dp.SQL != nil {
+			if err := dp.SQL.validate(); err != nil {
+				problem("datapoint %q: %v", dp.Title, err)
+			}
+		}
+		if err := dp.validateFormat(); err != nil {
+			problem("datapoint %q: %v", dp.Title, err)
+		}
+		if err := dp.validateKeys(); err != nil {
+			problem("datapoint %q: %v", dp.Title, err)
+		}
+		if err := dp.validateStalePolicy(cfg); err != nil {
+			problem("datapoint %q: %v", dp.Title, err)
+		}
+		if dp.Columns != nil {
+			if err := dp.validateColumns(); err != nil {
+				problem("datapoint %q: %v", dp.Title, err)
+			}
+		}
+		checkSchedule("datapoint "+strconv.Quote(dp.Title), dp.Schedule)
+	}
+	if cfg.KPI == nil && cfg.Datapoints != nil && cfg.SheetDataStartRow == "" {
+		problems = append(problems, errors.New("sheet-data-start-row is not set"))
+	}
+
+	return problems
+}
+
+// listTopics prints each topic in the topic row with its column letter
+func listTopics(cfg *Config, sink Sink, out io.Writer) error {
+	topics, err := sink.LookupTopic(cfg.SheetName, cfg.SheetTopicRow)
+	if err != nil {
+		return fmt.Errorf("read topic row %s of %s: %w", cfg.SheetTopicRow, cfg.SheetName, err)
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLUMN\tTOPIC")
+	for col, topic := range topics {
+		if topic != "" {
+			fmt.Fprintf(tw, "%s\t%v\n", clmconv.Itoa(col), topic)
+		}
+	}
+	return tw.Flush()
+}
+
+// listKeys prints each key in the key column with its row number
+func listKeys(cfg *Config, sink Sink, out io.Writer) error {
+	startRow, err := strconv.Atoi(cfg.SheetDataStartRow)
+	if err != nil {
+		return fmt.Errorf("sheet-data-start-row %q is not a row number", cfg.SheetDataStartRow)
+	}
+	keys, err := sink.LookupKey(cfg.SheetName, cfg.SheetKeyCol, startRow)
+	if err != nil {
+		return fmt.Errorf("read key column %s of %s: %w", cfg.SheetKeyCol, cfg.SheetName, err)
+	}
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tKEY")
+	for i, row := range keys {
+		if len(row) > 0 && row[0] != "" {
+			fmt.Fprintf(tw, "%d\t%v\n", startRow+i, row[0])
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	overrides := configOverrides{}
+	addConfigFlags(fs, overrides)
+	if err := fs.Parse([]string{"--sheet-name", "Other", "--dry-run", "--plan-format=json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := kpiTestConfig()
+	overrides.apply(cfg)
+	if cfg.SheetName != "Other" || cfg.DryRun != "yes" || cfg.PlanFormat != "json" {
+		t.Errorf("got sheet-name %q, dry-run %q, plan-format %q", cfg.SheetName, cfg.DryRun, cfg.PlanFormat)
+	}
+	if cfg.SheetKeyCol != "C" {
+		t.Errorf("sheet-key-col changed to %q without a flag", cfg.SheetKeyCol)
+	}
+}
+
+func TestConfigOnly(t *testing.T) {
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "A"}, {Title: "B"}, {Title: "C"}}
+	cfg.Datapoints = []Datapoint{{Title: "D"}}
+
+	if err := cfg.only([]string{"C", "A"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.KPI) != 2 || cfg.KPI[0].Title != "A" || cfg.KPI[1].Title != "C" || cfg.Datapoints != nil {
+		t.Errorf("got KPIs %v, datapoints %v", cfg.KPI, cfg.Datapoints)
+	}
+	if err := cfg.only([]string{"B"}); err == nil {
+		t.Error("expected an error for a title filtered out earlier")
+	}
+
+	cfg = datapointTestConfig()
+	cfg.KPI = []KPIs{{Title: "A"}}
+	if err := cfg.only([]string{"maxReplica"}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.KPI != nil || len(cfg.Datapoints) != 1 {
+		t.Errorf("datapoints would not be synced: KPIs %v", cfg.KPI)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "A", SheetRow: "3", Schedule: "@weekly"}}
+	if problems := validateConfig(cfg); len(problems) > 0 {
+		t.Errorf("valid config has problems: %v", problems)
+	}
+
+	cfg.SheetName = ""
+	cfg.PlanFormat = "yaml"
+	cfg.KPI = append(cfg.KPI, KPIs{Title: "B", SheetRow: "x", Schedule: "every day"})
+	cfg.Datapoints = []Datapoint{{
+		Title:       "dp",
+		Command:     "echo",
+		Columns:     map[string]string{"cpu": "CPU", "cores": "CPU"},
+		Format:      "xml",
+		StalePolicy: "archive",
+		KeyCols:     []string{"A", "B"},
+		KeyFields:   []string{"app"},
+	}}
+	var got []string
+	for _, err := range validateConfig(cfg) {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{
+		"sheet-name is not set",
+		"plan-format",
+		`KPI "B": sheet-row`,
+		`KPI "B": invalid schedule`,
+		`datapoint "dp": columns "cores" and "cpu" both write topic "CPU"`,
+		`datapoint "dp": format "xml"`,
+		`datapoint "dp": stale-policy archive needs an archive-sheet`,
+		`datapoint "dp": key-fields has 1 fields for the 2 key-cols`,
+	} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("missing problem %q in %q", want, got)
+		}
+	}
+}
+
+func TestBackfillTargets(t *testing.T) {
+	periods, _ := newPeriodFormat(&Config{Period: "month"})
+	targets, err := backfillTargets(periods, "2020-01-15", "2020-03-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, target := range targets {
+		if !target.Backfill {
+			t.Errorf("target %v is not a backfill", target.At)
+		}
+		got = append(got, periods.topic(target.At))
+	}
+	if want := "2020-01 2020-02 2020-03"; strings.Join(got, " ") != want {
+		t.Errorf("periods = %q, want %q", got, want)
+	}
+
+	for _, test := range [][2]string{
+		{"2020-03-01", "2020-01-15"}, // Backwards
+		{"15.01.2020", ""},
+		{"2020-01-15", "soon"},
+	} {
+		if _, err := backfillTargets(periods, test[0], test[1]); err == nil {
+			t.Errorf("backfill from %q to %q did not fail", test[0], test[1])
+		}
+	}
+}
+
+func TestListTopicsAndKeys(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "", "2020-07"})
+	fake.set("KPI data", "C3", []interface{}{"First"}, []interface{}{""}, []interface{}{"Third"})
+
+	var out bytes.Buffer
+	if err := listTopics(cfg, fake.sink(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "COLUMN  TOPIC\nB       Last update\nC       KPI\nE       2020-07\n"; out.String() != want {
+		t.Errorf("got topics\n%s\nwant\n%s", out.String(), want)
+	}
+
+	out.Reset()
+	if err := listKeys(cfg, fake.sink(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := "ROW  KEY\n3    First\n5    Third\n"; out.String() != want {
+		t.Errorf("got keys\n%s\nwant\n%s", out.String(), want)
+	}
+}
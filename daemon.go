@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// isScheduled tells if a schedule is set for the config or any of its
+// KPIs or datapoints, which makes kpi-uploader run as a daemon.
+func isScheduled(cfg *Config) bool {
+	if cfg.Schedule != "" {
+		return true
+	}
+	for _, kpi := range cfg.KPI {
+		if kpi.Schedule != "" {
+			return true
+		}
+	}
+	for _, dp := range cfg.Datapoints {
+		if dp.Schedule != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledConfigs splits the config into one config per cron expression,
+// holding the KPIs or datapoints to sync on that schedule, and the KPIs
+// their expressions refer to. As for a single run, datapoints are only used when there are no KPIs.
+func scheduledConfigs(cfg *Config) map[string]*Config {
+	configs := make(map[string]*Config)
+	configFor := func(title, schedule string) *Config {
+		if schedule == "" {
+			schedule = cfg.Schedule
+		}
+		if schedule == "" {
+			logit.WithFields(log.Fields{
+				"kpi": title,
+			}).Warning("No schedule, never syncing")
+			return nil
+		}
+		if _, ok := configs[schedule]; !ok {
+			sub := *cfg
+			sub.KPI = nil
+			sub.Datapoints = nil
+			configs[schedule] = &sub
+		}
+		return configs[schedule]
+	}
+
+	if cfg.KPI != nil {
+		for _, kpi := range cfg.KPI {
+			if sub := configFor(kpi.Title, kpi.Schedule); sub != nil {
+				sub.KPI = append(sub.KPI, kpi)
+			}
+		}
+
+		// Expressions need the KPIs they are computed from, which can be
+		// on another schedule
+		for _, sub := range configs {
+			var titles []string
+			for _, kpi := range sub.KPI {
+				titles = append(titles, kpi.Title)
+			}
+			sub.KPI = cfg.KPI
+			_ = sub.only(titles) // Never fails, the titles are from the same KPIs
+		}
+		return configs
+	}
+	for _, dp := range cfg.Datapoints {
+		if sub := configFor(dp.Title, dp.Schedule); sub != nil {
+			sub.Datapoints = append(sub.Datapoints, dp)
+		}
+	}
+	return configs
+}
+
+// runDaemon syncs on the configured schedules until SIGTERM or SIGINT,
+// then waits for a running sync to finish.
+func runDaemon(cfg *Config, sink Sink) error {
+	scheduler := cron.New()
+	for schedule, sub := range scheduledConfigs(cfg) {
+		sub := sub
+		if _, err := scheduler.AddFunc(schedule, func() { runSync(sub, sink, syncTarget{At: time.Now()}) }); err != nil {
+			return fmt.Errorf("invalid schedule %q: %w", schedule, err)
+		}
+		logit.WithFields(log.Fields{
+			"schedule":   schedule,
+			"kpis":       len(sub.KPI),
+			"datapoints": len(sub.Datapoints),
+		}).Info("Scheduled sync")
+	}
+	scheduler.Start()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+
+	logit.WithFields(log.Fields{
+		"signal": sig,
+	}).Info("Stopping scheduler, waiting for running sync")
+	<-scheduler.Stop().Done()
+
+	return nil
+}
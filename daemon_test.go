@@ -0,0 +1,79 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestScheduledConfigs(t *testing.T) {
+	cfg := &Config{
+		Schedule: "0 6 * * 1",
+		KPI: []KPIs{
+			{Title: "Weekly"},
+			{Title: "Hourly", Schedule: "@hourly"},
+			{Title: "Also weekly"},
+		},
+		Datapoints: []Datapoint{{Title: "Ignored when there are KPIs"}},
+	}
+
+	configs := scheduledConfigs(cfg)
+
+	if len(configs) != 2 {
+		t.Fatalf("got %d schedules, want 2", len(configs))
+	}
+	weekly := configs["0 6 * * 1"]
+	if len(weekly.KPI) != 2 || weekly.KPI[0].Title != "Weekly" || weekly.KPI[1].Title != "Also weekly" {
+		t.Errorf("weekly KPIs = %v", weekly.KPI)
+	}
+	if hourly := configs["@hourly"]; len(hourly.KPI) != 1 || hourly.KPI[0].Title != "Hourly" {
+		t.Errorf("hourly KPIs = %v", hourly.KPI)
+	}
+	for schedule, sub := range configs {
+		if sub.Datapoints != nil {
+			t.Errorf("schedule %q has datapoints", schedule)
+		}
+	}
+	if len(cfg.KPI) != 3 {
+		t.Error("the original config was modified")
+	}
+}
+
+func TestScheduledConfigsExpressionDependencies(t *testing.T) {
+	cfg := &Config{
+		Schedule: "@daily",
+		KPI: []KPIs{
+			{Title: "Migrated", Schedule: "@hourly"},
+			{Title: "Not migrated"},
+			{Title: "Percent migrated", Expression: "[Migrated] / ([Migrated] + [Not migrated]) * 100"},
+		},
+	}
+
+	configs := scheduledConfigs(cfg)
+	var titles []string
+	for _, kpi := range configs["@daily"].KPI {
+		titles = append(titles, kpi.Title)
+	}
+	if got, want := strings.Join(titles, ", "), "Migrated, Not migrated, Percent migrated"; got != want {
+		t.Errorf("daily KPIs = %s, want %s", got, want)
+	}
+	if hourly := configs["@hourly"]; len(hourly.KPI) != 1 {
+		t.Errorf("hourly KPIs = %v, want only Migrated", hourly.KPI)
+	}
+}
+
+func TestScheduledConfigsWithoutDefault(t *testing.T) {
+	cfg := &Config{
+		Datapoints: []Datapoint{
+			{Title: "Unscheduled"},
+			{Title: "Daily", Schedule: "@daily"},
+		},
+	}
+
+	if !isScheduled(cfg) {
+		t.Error("want a per datapoint schedule to enable daemon mode")
+	}
+	configs := scheduledConfigs(cfg)
+	if len(configs) != 1 || len(configs["@daily"].Datapoints) != 1 {
+		t.Errorf("got schedules %v, want only @daily", configs)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// datapointFormats are the output formats a datapoint command can use
+var datapointFormats = map[string]bool{"jsonl": true, "json": true, "csv": true, "tsv": true}
+
+// keySeparator joins the parts of a composite key
+const keySeparator = " | "
+
+// datapointRecord is a key and its fields in the output of a datapoint
+type datapointRecord struct {
+	Line   int // Line number, or item number of a JSON array
+	Key    string
+	object string            // The JSON object, for jsonl and json
+	fields map[string]string // The columns, for csv and tsv
+}
+
+// field returns the value of a field of the record, JSON fields can be
+// gjson paths
+func (r *datapointRecord) field(name string) (string, bool) {
+	if r.fields != nil {
+		v, ok := r.fields[name]
+		return v, ok
+	}
+	v := gjson.Get(r.object, name)
+	return v.String(), v.Exists()
+}
+
+// format returns the output format of the datapoint, queries always give
+// JSON lines
+func (dp *Datapoint) format() string {
+	if dp.Format == "" || dp.Prometheus != nil || dp.SQL != nil {
+		return "jsonl"
+	}
+	return dp.Format
+}
+
+// keyField returns the field of the datapoint output holding the keys
+func (dp *Datapoint) keyField() string {
+	if dp.KeyField == "" || dp.Prometheus != nil || dp.SQL != nil {
+		return "key"
+	}
+	return dp.KeyField
+}
+
+// valueField returns the field of the datapoint output holding the values
+func (dp *Datapoint) valueField() string {
+	if dp.ValueField == "" || dp.Prometheus != nil || dp.SQL != nil {
+		return "val"
+	}
+	return dp.ValueField
+}
+
+// keyCols returns the key columns of the datapoint, several for a
+// composite key
+func (dp *Datapoint) keyCols(cfg *Config) []string {
+	if len(dp.KeyCols) > 0 {
+		return dp.KeyCols
+	}
+	if dp.KeyCol != "" {
+		return []string{dp.KeyCol}
+	}
+	return []string{cfg.SheetKeyCol}
+}
+
+// isKeyCol tells if a column is one of the key columns of the datapoint
+func (dp *Datapoint) isKeyCol(cfg *Config, col string) bool {
+	for _, keyCol := range dp.keyCols(cfg) {
+		if col == keyCol {
+			return true
+		}
+	}
+	return false
+}
+
+// recordKey returns the key of a record, the key fields of a composite key
+// are joined like the key columns
+func (dp *Datapoint) recordKey(r *datapointRecord, normalizer *keyNormalizer) (string, error) {
+	fields := dp.KeyFields
+	if len(fields) == 0 {
+		fields = []string{dp.keyField()}
+	}
+	parts := make([]string, len(fields))
+	empty := true
+	for i, field := range fields {
+		v, ok := r.field(field)
+		if !ok {
+			return "", fmt.Errorf("no %q field", field)
+		}
+		parts[i] = normalizer.normalize(v)
+		empty = empty && parts[i] == ""
+	}
+	if empty {
+		return "", fmt.Errorf("empty key in %q", strings.Join(fields, ", "))
+	}
+	return strings.Join(parts, keySeparator), nil
+}
+
+// lookupKeys returns the cells of the key columns like Sink.LookupKey,
+// with the cells of a composite key joined into one, and normalized
+func lookupKeys(sink Sink, sheetName string, keyCols []string, dataStartRow int, normalizer *keyNormalizer) ([][]interface{}, error) {
+	if len(keyCols) == 1 {
+		keys, err := sink.LookupKey(sheetName, keyCols[0], dataStartRow)
+		if err != nil || normalizer == nil {
+			return keys, err
+		}
+		for _, row := range keys {
+			if len(row) > 0 {
+				row[0] = normalizer.normalize(fmt.Sprintf("%v", row[0]))
+			}
+		}
+		return keys, nil
+	}
+	var ranges []string
+	for _, col := range keyCols {
+		ranges = append(ranges, fmt.Sprintf("%s!%s%d:%s", sheetName, col, dataStartRow, col))
+	}
+	columns, err := sink.BatchRead(ranges, false)
+	if err != nil {
+		return nil, err
+	}
+	rows := 0
+	for _, cells := range columns {
+		if len(cells) > rows {
+			rows = len(cells)
+		}
+	}
+	keys := make([][]interface{}, rows)
+	for r := range keys {
+		parts := make([]string, len(columns))
+		empty := true
+		for c, cells := range columns {
+			if r < len(cells) && len(cells[r]) > 0 {
+				parts[c] = normalizer.normalize(fmt.Sprintf("%v", cells[r][0]))
+			}
+			empty = empty && parts[c] == ""
+		}
+		keys[r] = []interface{}{}
+		if !empty {
+			keys[r] = []interface{}{strings.Join(parts, keySeparator)}
+		}
+	}
+	return keys, nil
+}
+
+// validateKeys checks the key columns and fields of the datapoint
+func (dp *Datapoint) validateKeys() error {
+	if len(dp.KeyCols) == 0 {
+		if len(dp.KeyFields) > 0 {
+			return errors.New("key-fields needs key-cols")
+		}
+		return nil
+	}
+	switch {
+	case dp.KeyCol != "":
+		return errors.New("key-col and key-cols can not both be set")
+	case dp.KeyField != "":
+		return errors.New("key-field and key-cols can not both be set, use key-fields")
+	case dp.Prometheus != nil:
+		return errors.New("key-cols needs a command or sql, prometheus gives a single key")
+	case len(dp.KeyFields) != len(dp.KeyCols):
+		return fmt.Errorf("key-fields has %d fields for the %d key-cols", len(dp.KeyFields), len(dp.KeyCols))
+	}
+	return nil
+}
+
+// validateFormat checks the output format and fields of the datapoint
+func (dp *Datapoint) validateFormat() error {
+	if dp.Prometheus != nil || dp.SQL != nil {
+		if dp.Format != "" || dp.KeyField != "" || dp.ValueField != "" {
+			return errors.New("format, key-field and value-field are for a command, queries give keys and values")
+		}
+		return nil
+	}
+	if dp.Format != "" && !datapointFormats[dp.Format] {
+		return fmt.Errorf("format %q is not jsonl, json, csv or tsv", dp.Format)
+	}
+	return nil
+}
+
+// parseDatapointOutput reads the records of the datapoint output. A record
+// without a key fails the output, with the line it is on.
+func parseDatapointOutput(dp *Datapoint, out string, normalizer *keyNormalizer) ([]datapointRecord, error) {
+	var records []datapointRecord
+	var err error
+	switch dp.format() {
+	case "json":
+		records, err = parseJSONArray(out)
+	case "csv":
+		records, err = parseCSV(out, ',')
+	case "tsv":
+		records, err = parseCSV(out, '\t')
+	default:
+		records, err = parseJSONLines(out)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	item := "line"
+	if dp.format() == "json" {
+		item = "item"
+	}
+	for i := range records {
+		key, err := dp.recordKey(&records[i], normalizer)
+		if err != nil {
+			return nil, fmt.Errorf("%s %d: %w", item, records[i].Line, err)
+		}
+		records[i].Key = key
+	}
+	return records, nil
+}
+
+// parseJSONLines reads a JSON object per line, blank lines are skipped
+func parseJSONLines(out string) ([]datapointRecord, error) {
+	var records []datapointRecord
+	for i, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !gjson.Valid(line) || !gjson.Parse(line).IsObject() {
+			return nil, fmt.Errorf("line %d: not a JSON object: %s", i+1, snippet([]byte(line)))
+		}
+		records = append(records, datapointRecord{Line: i + 1, object: line})
+	}
+	return records, nil
+}
+
+// parseJSONArray reads an array of JSON objects
+func parseJSONArray(out string) ([]datapointRecord, error) {
+	if !gjson.Valid(out) || !gjson.Parse(out).IsArray() {
+		return nil, fmt.Errorf("output is not a JSON array: %s", snippet([]byte(out)))
+	}
+	var records []datapointRecord
+	for i, item := range gjson.Parse(out).Array() {
+		if !item.IsObject() {
+			return nil, fmt.Errorf("item %d: not a JSON object: %s", i+1, snippet([]byte(item.Raw)))
+		}
+		records = append(records, datapointRecord{Line: i + 1, object: item.Raw})
+	}
+	return records, nil
+}
+
+// parseCSV reads rows with the field names in a header row, blank lines
+// are skipped. Quoted values can span lines.
+func parseCSV(out string, comma rune) ([]datapointRecord, error) {
+	lines := strings.Split(out, "\n")
+	src := &lineReader{s: out}
+	r := csv.NewReader(src)
+	r.Comma = comma
+	r.LazyQuotes = comma == '\t'
+	r.TrimLeadingSpace = comma == ','
+	r.FieldsPerRecord = -1
+
+	var header []string
+	var records []datapointRecord
+	for {
+		// The row starts on the first line after the last row which is
+		// not empty, as empty lines are skipped by the reader
+		line := src.lines + 1
+		for line < len(lines) && strings.TrimSuffix(lines[line-1], "\r") == "" {
+			line++
+		}
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			if parseErr.StartLine != parseErr.Line {
+				return nil, fmt.Errorf("row on line %d, line %d, column %d: %w",
+					parseErr.StartLine, parseErr.Line, parseErr.Column, parseErr.Err)
+			}
+			return nil, fmt.Errorf("line %d, column %d: %w", parseErr.Line, parseErr.Column, parseErr.Err)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue // A line of spaces
+		}
+		if header == nil {
+			header = row
+			continue
+		}
+		if len(row) != len(header) {
+			return nil, fmt.Errorf("line %d: %d fields, the header has %d", line, len(row), len(header))
+		}
+		fields := make(map[string]string, len(header))
+		for j, name := range header {
+			fields[strings.TrimSpace(name)] = strings.TrimSpace(row[j])
+		}
+		records = append(records, datapointRecord{Line: line, fields: fields})
+	}
+	return records, nil
+}
+
+// lineReader reads a string a byte at a time, counting the lines read, so
+// the lines a csv.Reader has used are known between its rows
+type lineReader struct {
+	s     string
+	lines int
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if l.s == "" {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	p[0] = l.s[0]
+	if p[0] == '\n' {
+		l.lines++
+	}
+	l.s = l.s[1:]
+	return 1, nil
+}
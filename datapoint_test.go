@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDatapointOutput(t *testing.T) {
+	for _, test := range []struct {
+		dp   Datapoint
+		out  string
+		want string
+	}{
+		{Datapoint{}, "{\"key\":\"app1\",\"val\":3}\n\n{\"key\":\"app2\",\"val\":\"5\"}\n", "app1=3 app2=5"},
+		{Datapoint{Format: "json", KeyField: "name", ValueField: "spec.replicas"},
+			`[{"name":"app1","spec":{"replicas":3}},{"name":"app2","spec":{"replicas":5}}]`, "app1=3 app2=5"},
+		{Datapoint{Format: "csv", KeyField: "app", ValueField: "replicas"}, "app, replicas\napp1,3\r\n\n\"app 2\", 5\n", "app1=3 app 2=5"},
+		{Datapoint{Format: "tsv", KeyField: "app", ValueField: "replicas"}, "app\treplicas\napp1\t3\napp2\t\n", "app1=3 app2="},
+		{Datapoint{Format: "csv", KeyField: "app"}, "app\n", ""},
+		{Datapoint{Format: "csv", KeyField: "app", ValueField: "replicas"},
+			"app,note,replicas\napp1,\"two\nlines\",3\n\n  \napp2,,5\n", "app1=3 app2=5"},
+	} {
+		records, err := parseDatapointOutput(&test.dp, test.out, nil)
+		if err != nil {
+			t.Errorf("%s: %v", test.dp.Format, err)
+			continue
+		}
+		var got []string
+		for _, record := range records {
+			val, _ := record.field(test.dp.valueField())
+			got = append(got, record.Key+"="+val)
+		}
+		if strings.Join(got, " ") != test.want {
+			t.Errorf("%s: records %q, want %q", test.dp.Format, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		dp   Datapoint
+		out  string
+		want string
+	}{
+		{Datapoint{}, "{\"key\":\"app1\",\"val\":3}\n\nnot json\n", "line 3: not a JSON object"},
+		{Datapoint{}, "{\"key\":\"app1\",\"val\":3}\n{\"val\":5}\n", `line 2: no "key" field`},
+		{Datapoint{}, "{\"key\":\"\",\"val\":5}\n", `line 1: empty key`},
+		{Datapoint{Format: "json"}, `{"key":"app1"}`, "not a JSON array"},
+		{Datapoint{Format: "json"}, `[{"key":"app1"},3]`, "item 2: not a JSON object"},
+		{Datapoint{Format: "csv"}, "key,val\napp1,3\napp2\n", "line 3: 1 fields, the header has 2"},
+		{Datapoint{Format: "csv"}, "key,val\napp1,\"3\n", "line 2, column"},
+		{Datapoint{Format: "csv"}, "key,val\n\"app\n1\",3\n\napp2\n", "line 5: 1 fields"},
+		{Datapoint{Format: "csv", KeyField: "app"}, "key,val\n\"app\n1\",3\n", `line 2: no "app" field`},
+		{Datapoint{Format: "csv"}, "key,val\napp1,3\"\n", "line 2, column"},
+		{Datapoint{Format: "csv"}, "key,val\n\"app\n1\"x,3\n", "row on line 2, line 3, column"},
+		{Datapoint{Format: "tsv", KeyField: "app"}, "key\tval\napp1\t3\n", `line 2: no "app" field`},
+		{Datapoint{KeyCols: []string{"A", "B"}, KeyFields: []string{"cluster", "app"}}, "{\"cluster\":\"prod\"}\n", `line 1: no "app" field`},
+		{Datapoint{KeyCols: []string{"A", "B"}, KeyFields: []string{"cluster", "app"}}, "{\"cluster\":\"\",\"app\":\"\"}\n", `line 1: empty key`},
+	} {
+		if _, err := parseDatapointOutput(&test.dp, test.out, nil); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q gave %v, want %q", test.out, err, test.want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesCSV(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica", "cpuRequest"},
+		[]interface{}{"app1"},
+		[]interface{}{"app2"})
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{
+		{Title: "maxReplica", Command: "cat", Args: "testdata/deployments.csv", Format: "csv", KeyField: "app", ValueField: "replicas"},
+		{Title: "cpu", Command: "cat", Args: "testdata/deployments.csv", Format: "csv", KeyField: "app",
+			Columns: map[string]string{"cpu": "cpuRequest"}},
+		{Title: "broken", Command: "cat", Args: "testdata/deployments.csv", Columns: map[string]string{"cpu": "cpuRequest"}},
+	}
+
+	summary := updateGoogleSheetValues(cfg, fake.sink())
+	if errs := summary.Errors["broken"]; len(errs) != 1 || !strings.Contains(errs[0].Error(), "line 1") {
+		t.Errorf("broken datapoint gave %v, want the malformed line", errs)
+	}
+	for cell, want := range map[string]interface{}{
+		"B2": 3.0,
+		"B3": 5.0,
+		"C2": 2.0,
+		"C3": 0.5,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesCompositeKeys(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"cluster", "namespace", "app", "maxReplica"},
+		[]interface{}{"prod", "team-a", "web"},
+		[]interface{}{"prod", "team-b", "web"},
+		[]interface{}{"dev", "team-a", "web"},
+		[]interface{}{"dev", "team-b", "web", 4.0})
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{{
+		Title:      "maxReplica",
+		Command:    "cat",
+		Args:       "testdata/cluster-deployments.jsonl",
+		KeyCols:    []string{"A", "B", "C"},
+		KeyFields:  []string{"cluster", "namespace", "app"},
+		ValueField: "replicas",
+	}}
+
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"D2": 3.0,
+		"D3": 5.0,
+		"D4": 1.0,
+		"D5": 4.0,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expressions compute a KPI from the values of other KPIs, i.e
+//
+//   [Migrated] / ([Migrated] + [Not migrated]) * 100
+//
+// with the KPIs referred to by title in brackets, numbers, + - * / and
+// parentheses. previous[Title] is the value of a KPI in the previous
+// period, as read from the sheet.
+
+// exprNode is a parsed expression
+type exprNode struct {
+	op       byte     // '+', '-', '*', '/', 'n' for a number, 'r' for a KPI, 'p' for a previous KPI, 'u' for a negation
+	value    *big.Rat // Number
+	title    string   // KPI title
+	operands []*exprNode
+}
+
+// exprParser is a recursive descent parser of expressions
+type exprParser struct {
+	text string
+	pos  int
+}
+
+// parseExpression parses an expression
+func parseExpression(text string) (*exprNode, error) {
+	p := &exprParser{text: text}
+	node, err := p.sum()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.text) {
+		return nil, p.errorf("unexpected %q", p.text[p.pos:])
+	}
+	return node, nil
+}
+
+func (p *exprParser) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("expression %q at %d: %s", p.text, p.pos+1, fmt.Sprintf(format, a...))
+}
+
+func (p *exprParser) skipSpace() {
+	for p.pos < len(p.text) && unicode.IsSpace(rune(p.text[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character, or 0 at the end
+func (p *exprParser) peek() byte {
+	if p.skipSpace(); p.pos < len(p.text) {
+		return p.text[p.pos]
+	}
+	return 0
+}
+
+// sum is term (('+'|'-') term)*
+func (p *exprParser) sum() (*exprNode, error) {
+	node, err := p.term()
+	for err == nil && (p.peek() == '+' || p.peek() == '-') {
+		op := p.text[p.pos]
+		p.pos++
+		var right *exprNode
+		if right, err = p.term(); err == nil {
+			node = &exprNode{op: op, operands: []*exprNode{node, right}}
+		}
+	}
+	return node, err
+}
+
+// term is unary (('*'|'/') unary)*
+func (p *exprParser) term() (*exprNode, error) {
+	node, err := p.unary()
+	for err == nil && (p.peek() == '*' || p.peek() == '/') {
+		op := p.text[p.pos]
+		p.pos++
+		var right *exprNode
+		if right, err = p.unary(); err == nil {
+			node = &exprNode{op: op, operands: []*exprNode{node, right}}
+		}
+	}
+	return node, err
+}
+
+// unary is '-' unary, '(' sum ')', a number, [Title] or previous[Title]
+func (p *exprParser) unary() (*exprNode, error) {
+	switch c := p.peek(); {
+	case c == '-':
+		p.pos++
+		node, err := p.unary()
+		return &exprNode{op: 'u', operands: []*exprNode{node}}, err
+	case c == '(':
+		p.pos++
+		node, err := p.sum()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing )")
+		}
+		p.pos++
+		return node, nil
+	case c == '[':
+		title, err := p.title()
+		return &exprNode{op: 'r', title: title}, err
+	case strings.HasPrefix(p.text[p.pos:], "previous["):
+		p.pos += len("previous")
+		title, err := p.title()
+		return &exprNode{op: 'p', title: title}, err
+	case c == '.' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.text) && (p.text[p.pos] == '.' || (p.text[p.pos] >= '0' && p.text[p.pos] <= '9')) {
+			p.pos++
+		}
+		value, ok := new(big.Rat).SetString(p.text[start:p.pos])
+		if !ok {
+			return nil, p.errorf("bad number %q", p.text[start:p.pos])
+		}
+		return &exprNode{op: 'n', value: value}, nil
+	case c == 0:
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", p.text[p.pos:])
+}
+
+// title reads a [Title]
+func (p *exprParser) title() (string, error) {
+	end := strings.IndexByte(p.text[p.pos:], ']')
+	if end < 0 {
+		return "", p.errorf("missing ]")
+	}
+	title := strings.TrimSpace(p.text[p.pos+1 : p.pos+end])
+	if title == "" {
+		return "", p.errorf("empty KPI title")
+	}
+	p.pos += end + 1
+	return title, nil
+}
+
+// refs adds the titles of the KPIs and previous KPIs referred to
+func (n *exprNode) refs(current, previous map[string]bool) {
+	switch n.op {
+	case 'r':
+		current[n.title] = true
+	case 'p':
+		previous[n.title] = true
+	}
+	for _, o := range n.operands {
+		o.refs(current, previous)
+	}
+}
+
+// eval computes the expression from the KPI values and previous values
+func (n *exprNode) eval(values, previous map[string]*big.Rat) (*big.Rat, error) {
+	switch n.op {
+	case 'n':
+		return n.value, nil
+	case 'r', 'p':
+		source, what := values, "value"
+		if n.op == 'p' {
+			source, what = previous, "previous value"
+		}
+		v, ok := source[n.title]
+		if !ok {
+			return nil, fmt.Errorf("no %s for KPI %q", what, n.title)
+		}
+		return v, nil
+	}
+
+	var operands []*big.Rat
+	for _, o := range n.operands {
+		v, err := o.eval(values, previous)
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, v)
+	}
+	r := new(big.Rat)
+	switch n.op {
+	case 'u':
+		return r.Neg(operands[0]), nil
+	case '+':
+		return r.Add(operands[0], operands[1]), nil
+	case '-':
+		return r.Sub(operands[0], operands[1]), nil
+	case '*':
+		return r.Mul(operands[0], operands[1]), nil
+	}
+	if operands[1].Sign() == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return r.Quo(operands[0], operands[1]), nil
+}
+
+// expressionOrder returns the indexes of the expression KPIs, each after
+// the expressions it depends on. An expression which can not be parsed,
+// refers to an unknown KPI or is part of a cycle gets an error instead.
+func expressionOrder(kpis []KPIs) ([]int, map[string]error) {
+	index := make(map[string]int)
+	for i, kpi := range kpis {
+		index[kpi.Title] = i
+	}
+	parsed := make(map[int]*exprNode)
+	errs := make(map[string]error)
+	for i, kpi := range kpis {
+		if kpi.Expression == "" {
+			continue
+		}
+		node, err := parseExpression(kpi.Expression)
+		if err != nil {
+			errs[kpi.Title] = err
+			continue
+		}
+		parsed[i] = node
+	}
+
+	// Depth first, in config order, so cycles are found where they close
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[int]int)
+	var order []int
+	var visit func(i int, path []string) error
+	visit = func(i int, path []string) error {
+		title := kpis[i].Title
+		switch state[i] {
+		case visiting:
+			return fmt.Errorf("expression cycle %s -> %s", strings.Join(path, " -> "), title)
+		case done:
+			return errs[title]
+		}
+		state[i] = visiting
+		defer func() { state[i] = done }()
+
+		current := make(map[string]bool)
+		parsed[i].refs(current, map[string]bool{})
+		for _, ref := range sortedKeys(current) {
+			j, ok := index[ref]
+			if !ok {
+				errs[title] = fmt.Errorf("expression refers to unknown KPI %q", ref)
+				return errs[title]
+			}
+			if _, isExpression := parsed[j]; !isExpression {
+				if kpis[j].Expression != "" { // Failed to parse
+					errs[title] = fmt.Errorf("expression depends on %q: %v", ref, errs[ref])
+					return errs[title]
+				}
+				continue
+			}
+			if err := visit(j, append(path, title)); err != nil {
+				errs[title] = err
+				return err
+			}
+		}
+		order = append(order, i)
+		return nil
+	}
+	for i := range kpis {
+		if _, ok := parsed[i]; ok && state[i] == unvisited {
+			_ = visit(i, nil)
+		}
+	}
+	return order, errs
+}
+
+// expressionRefs returns the titles an expression refers to for current
+// values, empty if it can not be parsed
+func expressionRefs(expression string) []string {
+	node, err := parseExpression(expression)
+	if err != nil {
+		return nil
+	}
+	current := make(map[string]bool)
+	node.refs(current, map[string]bool{})
+	return sortedKeys(current)
+}
+
+// sortedKeys returns the keys of a set in order
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expressionResult is the value of an expression KPI, or why it failed
+type expressionResult struct {
+	kpi   KPIs
+	value interface{}
+	err   error
+}
+
+// evaluateExpressions computes the expression KPIs of cfg after the KPIs
+// they depend on, from the values scraped so far by title, which it adds
+// to. Values of the previous period are read from the sheet.
+func evaluateExpressions(cfg *Config, sink Sink, periods *periodFormat, at time.Time,
+	values map[string]interface{}) []expressionResult {
+
+	order, errs := expressionOrder(cfg.KPI)
+	var results []expressionResult
+	for _, kpi := range cfg.KPI {
+		if err := errs[kpi.Title]; err != nil {
+			results = append(results, expressionResult{kpi: kpi, err: err})
+		}
+	}
+	if len(order) == 0 {
+		return results
+	}
+
+	// Read the previous values all of the expressions need at once
+	parsed := make(map[int]*exprNode)
+	previousTitles := make(map[string]bool)
+	for _, i := range order {
+		parsed[i], _ = parseExpression(cfg.KPI[i].Expression) // Parsed by expressionOrder
+		parsed[i].refs(map[string]bool{}, previousTitles)
+	}
+	previous, previousErrs := readPreviousValues(cfg, sink, periods, at, sortedKeys(previousTitles))
+
+	current := make(map[string]*big.Rat)
+	for title, v := range values {
+		if r, ok := new(big.Rat).SetString(fmt.Sprint(v)); ok {
+			current[title] = r
+		}
+	}
+	for _, i := range order {
+		kpi := cfg.KPI[i]
+		result := expressionResult{kpi: kpi}
+		needed := make(map[string]bool)
+		parsed[i].refs(map[string]bool{}, needed)
+		for _, title := range sortedKeys(needed) {
+			if err := previousErrs[title]; err != nil && result.err == nil {
+				result.err = fmt.Errorf("previous value of %q: %w", title, err)
+			}
+		}
+		if result.err == nil {
+			var r *big.Rat
+			if r, result.err = parsed[i].eval(current, previous); result.err == nil {
+				result.value, result.err = parseKPIValue(ratText(r), &kpi)
+			}
+		}
+		if result.err == nil {
+			values[kpi.Title] = result.value
+			current[kpi.Title], _ = new(big.Rat).SetString(fmt.Sprint(result.value))
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// readPreviousValues reads the values of KPIs in the period before the one
+// holding at, found as the KPIs are without adding any rows
+func readPreviousValues(cfg *Config, sink Sink, periods *periodFormat, at time.Time,
+	titles []string) (map[string]*big.Rat, map[string]error) {
+
+	values := make(map[string]*big.Rat)
+	errs := make(map[string]error)
+	if len(titles) == 0 {
+		return values, errs
+	}
+	fail := func(err error) (map[string]*big.Rat, map[string]error) {
+		for _, title := range titles {
+			errs[title] = err
+		}
+		return values, errs
+	}
+
+	col, err := cellValueToSheetLetter(cfg, sink, periods.topic(periods.previous(at)), false)
+	if err != nil {
+		return fail(err)
+	}
+	kpis := make([]KPIs, len(titles))
+	for i, title := range titles {
+		kpis[i] = KPIs{Title: title}
+		for _, kpi := range cfg.KPI {
+			if kpi.Title == title {
+				kpis[i].SheetRow = kpi.SheetRow
+			}
+		}
+	}
+	lookup := *cfg
+	lookup.AddKPIRows = ""
+	rows := kpiRows(&lookup, sink, kpis)
+
+	var cells, cellTitles []string
+	for i, row := range rows {
+		if row.err != nil {
+			errs[titles[i]] = row.err
+			continue
+		}
+		cells = append(cells, fmt.Sprintf("%s!%s%d", cfg.SheetName, col, row.row))
+		cellTitles = append(cellTitles, titles[i])
+	}
+	cellValues, err := readRanges(sink, cells, true)
+	if err != nil {
+		return fail(err)
+	}
+	for i, title := range cellTitles {
+		v := firstValue(cellValues[i])
+		r, ok := new(big.Rat).SetString(fmt.Sprint(v))
+		if v == nil || !ok {
+			errs[title] = fmt.Errorf("cell %s is %q, not a number", cells[i], fmt.Sprint(v))
+			continue
+		}
+		values[title] = r
+	}
+	return values, errs
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpression(t *testing.T) {
+	values := map[string]*big.Rat{"A": big.NewRat(30, 1), "B b": big.NewRat(10, 1)}
+	previous := map[string]*big.Rat{"A": big.NewRat(25, 1)}
+	for expression, want := range map[string]string{
+		"1 + 2 * 3":                   "7",
+		"(1 + 2) * 3":                 "9",
+		"10 - 4 - 3":                  "3",
+		"-[A] + 1":                    "-29",
+		"[A] / ([A] + [ B b ]) * 100": "75",
+		"[A] - previous[A]":           "5",
+		"1 / 3":                       "0.3333333333333333",
+		"0.5*4":                       "2",
+	} {
+		node, err := parseExpression(expression)
+		if err != nil {
+			t.Errorf("%s: %v", expression, err)
+			continue
+		}
+		r, err := node.eval(values, previous)
+		if err != nil {
+			t.Errorf("%s: %v", expression, err)
+		} else if got := ratText(r); got != want {
+			t.Errorf("%s = %s, want %s", expression, got, want)
+		}
+	}
+
+	for expression, want := range map[string]string{
+		"[A":            "missing ]",
+		"1 +":           "unexpected end",
+		"2 $ 3":         "unexpected",
+		"(1 + 2":        "missing )",
+		"[]":            "empty KPI title",
+		"[A] / 0":       "division by zero",
+		"[C] + 1":       `no value for KPI "C"`,
+		"previous[B b]": `no previous value for KPI "B b"`,
+	} {
+		node, err := parseExpression(expression)
+		if err == nil {
+			_, err = node.eval(values, previous)
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s gave %v, want %q", expression, err, want)
+		}
+	}
+}
+
+func TestExpressionOrder(t *testing.T) {
+	kpis := []KPIs{
+		{Title: "Sum", Expression: "[Double] + [A]"},
+		{Title: "A", KPICommand: "echo"},
+		{Title: "Double", Expression: "[A] * 2"},
+		{Title: "X", Expression: "[Y] + 1"},
+		{Title: "Y", Expression: "[X] + 1"},
+		{Title: "Unknown", Expression: "[Nothing]"},
+		{Title: "Broken", Expression: "[A] +"},
+		{Title: "Uses broken", Expression: "[Broken]"},
+		{Title: "Previous only", Expression: "[A] - previous[Removed KPI]"},
+	}
+	order, errs := expressionOrder(kpis)
+	var titles []string
+	for _, i := range order {
+		titles = append(titles, kpis[i].Title)
+	}
+	if got, want := strings.Join(titles, ", "), "Double, Sum, Previous only"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+	for title, want := range map[string]string{
+		"X":           "expression cycle X -> Y -> X",
+		"Y":           "expression cycle X -> Y -> X",
+		"Unknown":     `unknown KPI "Nothing"`,
+		"Broken":      "unexpected end",
+		"Uses broken": `depends on "Broken"`,
+	} {
+		if err := errs[title]; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: error %v, want %q", title, err, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIExpressions(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Percent migrated", SheetRow: "5", Expression: "[Migrated] / ([Migrated] + [Not migrated]) * 100", Precision: "1"},
+		{Title: "Migrated", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "30"},
+		{Title: "Not migrated", SheetRow: "4", KPICommand: "echo", KPICommandArgs: "11"},
+		{Title: "Migrated this week", SheetRow: "6", Expression: "[Migrated] - previous[Migrated]"},
+		{Title: "Cycle", SheetRow: "7", Expression: "[Cycle] + 1"},
+	}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", "2020-06", "2020-07"},
+		[]interface{}{"", "", "Migrated", 25})
+
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC) // Week 2020-07
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at})
+	if err := summary.Errors["Cycle"]; err == nil {
+		t.Errorf("cycle did not fail, errors %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"E3": 30.0,
+		"E4": 11.0,
+		"E5": 73.2,
+		"E6": 5.0,
+		"E7": nil,
+	} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+
+	// Without the previous week column, the week over week KPI fails alone
+	fake.set("KPI data", "D2", []interface{}{"2020-05"})
+	summary = updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at})
+	if err := summary.Errors["Migrated this week"]; err == nil {
+		t.Errorf("missing previous week did not fail, errors %v", summary.Errors)
+	}
+	if err := summary.Errors["Percent migrated"]; err != nil {
+		t.Errorf("Percent migrated failed: %v", err)
+	}
+}
+
+func TestConfigOnlyAddsExpressionDependencies(t *testing.T) {
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "A"}, {Title: "B"}, {Title: "C"},
+		{Title: "Ratio", Expression: "[Double] / [B]"},
+		{Title: "Double", Expression: "[A] * 2"},
+	}
+	if err := cfg.only([]string{"Ratio"}); err != nil {
+		t.Fatal(err)
+	}
+	var titles []string
+	for _, kpi := range cfg.KPI {
+		titles = append(titles, kpi.Title)
+	}
+	if got, want := strings.Join(titles, ", "), "A, B, Ratio, Double"; got != want {
+		t.Errorf("KPIs = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/option"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// fakeCell is a single cell in the fake spreadsheet. Formulas are stored
+// but never evaluated, and the format is any name given by the test.
+type fakeCell struct {
+	value   interface{}
+	formula string
+	format  string
+}
+
+// fakeSheets is an in-process stand-in for the subset of the Google
+// Sheets v4 REST API used by kpi-uploader.
+type fakeSheets struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu         sync.Mutex
+	sheets     map[string][][]fakeCell
+	sheetIDs   map[string]int64
+	failures   map[string][]int // Queued error codes per HTTP method
+	requests   map[string]int   // Request count per HTTP method
+	retryAfter string           // Retry-After header of simulated failures
+	sleeps     []time.Duration  // Retry delays of the sinks, which never sleep
+}
+
+const fakeSpreadsheetID = "fake-spreadsheet"
+
+func newFakeSheets(t *testing.T) *fakeSheets {
+	f := &fakeSheets{
+		t:        t,
+		sheets:   make(map[string][][]fakeCell),
+		sheetIDs: make(map[string]int64),
+		failures: make(map[string][]int),
+		requests: make(map[string]int),
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	return f
+}
+
+// Close shuts down the fake server
+func (f *fakeSheets) Close() {
+	f.server.Close()
+}
+
+// sink returns a Google Sheets sink talking to the fake server
+func (f *fakeSheets) sink() Sink {
+	srv, err := sheets.NewService(context.Background(),
+		option.WithEndpoint(f.server.URL+"/"),
+		option.WithHTTPClient(f.server.Client()))
+	if err != nil {
+		f.t.Fatalf("creating sheets service: %v", err)
+	}
+	retry := defaultRetryPolicy()
+	retry.sleep = func(d time.Duration) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.sleeps = append(f.sleeps, d)
+	}
+	return newGoogleSheetSink(srv, fakeSpreadsheetID, retry, &sheetsLimiter{})
+}
+
+// set stores rows of values starting at cell, i.e "A2"
+func (f *fakeSheets) set(sheet, cell string, rows ...[]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	col, row := parseA1Cell(cell)
+	for r, values := range rows {
+		for c, v := range values {
+			f.store(sheet, col+c, row+r, v, "RAW")
+		}
+	}
+}
+
+// setFormat sets the format of a single cell, i.e "C7"
+func (f *fakeSheets) setFormat(sheet, cell, format string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	col, row := parseA1Cell(cell)
+	f.grow(sheet, col, row)
+	f.sheets[sheet][row][col].format = format
+}
+
+// setFormula sets a formula in a single cell, with the value Sheets would
+// compute for it
+func (f *fakeSheets) setFormula(sheet, cell, formula string, value interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	col, row := parseA1Cell(cell)
+	f.store(sheet, col, row, value, "RAW")
+	f.sheets[sheet][row][col].formula = formula
+}
+
+// cell returns a single cell, i.e "C7"
+func (f *fakeSheets) cell(sheet, cell string) fakeCell {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	col, row := parseA1Cell(cell)
+	grid := f.sheets[sheet]
+	if row >= len(grid) || col >= len(grid[row]) {
+		return fakeCell{}
+	}
+	return grid[row][col]
+}
+
+// get returns the unformatted value of a single cell, i.e "C7"
+func (f *fakeSheets) get(sheet, cell string) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	col, row := parseA1Cell(cell)
+	grid := f.sheets[sheet]
+	if row >= len(grid) || col >= len(grid[row]) {
+		return nil
+	}
+	return grid[row][col].value
+}
+
+// failNext makes the next n requests with the given HTTP method fail
+// with the given status code, i.e 429 to simulate quota errors.
+func (f *fakeSheets) failNext(method string, n, code int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := 0; i < n; i++ {
+		f.failures[method] = append(f.failures[method], code)
+	}
+}
+
+// count returns the number of requests received with the given HTTP method
+func (f *fakeSheets) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeSheets) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.requests[r.Method]++
+	if codes := f.failures[r.Method]; len(codes) > 0 {
+		f.failures[r.Method] = codes[1:]
+		if f.retryAfter != "" {
+			w.Header().Set("Retry-After", f.retryAfter)
+		}
+		writeFakeError(w, codes[0], "simulated failure")
+		return
+	}
+
+	prefix := "/v4/spreadsheets/" + fakeSpreadsheetID
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		writeFakeError(w, http.StatusNotFound, "unknown spreadsheet")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && path == "":
+		resp := sheets.Spreadsheet{SpreadsheetId: fakeSpreadsheetID}
+		for title := range f.sheets {
+			resp.Sheets = append(resp.Sheets, &sheets.Sheet{
+				Properties: &sheets.SheetProperties{Title: title, SheetId: f.sheetIDs[title]},
+			})
+		}
+		writeFakeJSON(w, resp)
+
+	case r.Method == http.MethodPost && path == ":batchUpdate":
+		var req sheets.BatchUpdateSpreadsheetRequest
+		if !decodeFakeBody(w, r, &req) {
+			return
+		}
+		resp := sheets.BatchUpdateSpreadsheetResponse{SpreadsheetId: fakeSpreadsheetID}
+		for _, update := range req.Requests {
+			if err := f.update(update); err != nil {
+				writeFakeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			resp.Replies = append(resp.Replies, &sheets.Response{})
+		}
+		writeFakeJSON(w, resp)
+
+	case r.Method == http.MethodGet && path == "/values:batchGet":
+		resp := sheets.BatchGetValuesResponse{SpreadsheetId: fakeSpreadsheetID}
+		for _, rng := range query["ranges"] {
+			resp.ValueRanges = append(resp.ValueRanges,
+				f.read(rng, query.Get("valueRenderOption"), query.Get("majorDimension")))
+		}
+		writeFakeJSON(w, resp)
+
+	case r.Method == http.MethodPost && path == "/values:batchUpdate":
+		var req sheets.BatchUpdateValuesRequest
+		if !decodeFakeBody(w, r, &req) {
+			return
+		}
+		resp := sheets.BatchUpdateValuesResponse{SpreadsheetId: fakeSpreadsheetID}
+		for _, vr := range req.Data {
+			resp.Responses = append(resp.Responses, f.write(vr.Range, vr.Values, req.ValueInputOption))
+		}
+		writeFakeJSON(w, resp)
+
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "/values/"):
+		writeFakeJSON(w, f.read(strings.TrimPrefix(path, "/values/"), query.Get("valueRenderOption"), query.Get("majorDimension")))
+
+	case r.Method == http.MethodPut && strings.HasPrefix(path, "/values/"):
+		var vr sheets.ValueRange
+		if !decodeFakeBody(w, r, &vr) {
+			return
+		}
+		writeFakeJSON(w, f.write(strings.TrimPrefix(path, "/values/"), vr.Values, query.Get("valueInputOption")))
+
+	default:
+		writeFakeError(w, http.StatusNotImplemented, "not implemented by fake: "+r.Method+" "+path)
+	}
+}
+
+// read returns the values in a range, trimming trailing empty rows and
+// cells the same way the Sheets API does.
+func (f *fakeSheets) read(rng, renderOption, majorDimension string) *sheets.ValueRange {
+	sheet, c0, r0, c1, r1 := f.parseRange(rng)
+	grid := f.sheets[sheet]
+	if majorDimension == "COLUMNS" {
+		grid = transposeFakeGrid(grid)
+		c0, r0, c1, r1 = r0, c0, r1, c1
+	}
+	vr := &sheets.ValueRange{Range: rng, MajorDimension: "ROWS"}
+	if majorDimension == "COLUMNS" {
+		vr.MajorDimension = majorDimension
+	}
+	if r1 < 0 || r1 >= len(grid) {
+		r1 = len(grid) - 1
+	}
+	for r := r0; r <= r1; r++ {
+		row := []interface{}{}
+		if r >= len(grid) {
+			break
+		}
+		last := c1
+		if last < 0 || last >= len(grid[r]) {
+			last = len(grid[r]) - 1
+		}
+		for c := c0; c <= last; c++ {
+			row = append(row, renderFakeCell(grid[r][c], renderOption))
+		}
+		for len(row) > 0 && row[len(row)-1] == "" {
+			row = row[:len(row)-1]
+		}
+		vr.Values = append(vr.Values, row)
+	}
+	for len(vr.Values) > 0 && len(vr.Values[len(vr.Values)-1]) == 0 {
+		vr.Values = vr.Values[:len(vr.Values)-1]
+	}
+	return vr
+}
+
+// write stores values starting at the top left cell of a range
+func (f *fakeSheets) write(rng string, values [][]interface{}, inputOption string) *sheets.UpdateValuesResponse {
+	sheet, c0, r0, _, _ := f.parseRange(rng)
+	var cells int64
+	for r, row := range values {
+		for c, v := range row {
+			f.store(sheet, c0+c, r0+r, v, inputOption)
+			cells++
+		}
+	}
+	return &sheets.UpdateValuesResponse{
+		SpreadsheetId: fakeSpreadsheetID,
+		UpdatedRange:  rng,
+		UpdatedRows:   int64(len(values)),
+		UpdatedCells:  cells,
+	}
+}
+
+// store sets a single cell, parsing strings like the Sheets UI does
+// when the input option is USER_ENTERED.
+func (f *fakeSheets) store(sheet string, col, row int, v interface{}, inputOption string) {
+	f.grow(sheet, col, row)
+	grid := f.sheets[sheet]
+	cell := fakeCell{value: v, format: grid[row][col].format}
+	if s, ok := v.(string); ok {
+		switch {
+		case s == "":
+			cell.value = nil
+		case inputOption == "USER_ENTERED" && strings.HasPrefix(s, "="):
+			cell.formula = s
+		case inputOption == "USER_ENTERED":
+			if n, err := strconv.ParseFloat(s, 64); err == nil {
+				cell.value = n
+			}
+		}
+	}
+	grid[row][col] = cell
+}
+
+// grow makes room for a cell, giving new sheets an ID
+func (f *fakeSheets) grow(sheet string, col, row int) {
+	if _, ok := f.sheetIDs[sheet]; !ok {
+		f.sheetIDs[sheet] = int64(len(f.sheetIDs) + 1)
+	}
+	grid := f.sheets[sheet]
+	for len(grid) <= row {
+		grid = append(grid, nil)
+	}
+	for len(grid[row]) <= col {
+		grid[row] = append(grid[row], fakeCell{})
+	}
+	f.sheets[sheet] = grid
+}
+
+// update applies a spreadsheets.batchUpdate request
+func (f *fakeSheets) update(req *sheets.Request) error {
+	switch {
+	case req.InsertDimension != nil:
+		dr := req.InsertDimension.Range
+		sheet, err := f.sheetByID(dr.SheetId)
+		if err != nil {
+			return err
+		}
+		grid := f.sheets[sheet]
+		n := int(dr.EndIndex - dr.StartIndex)
+		if dr.Dimension == "ROWS" {
+			at := int(dr.StartIndex)
+			if at > len(grid) {
+				at = len(grid)
+			}
+			grid = append(grid[:at], append(make([][]fakeCell, n), grid[at:]...)...)
+		} else {
+			for r, row := range grid {
+				at := int(dr.StartIndex)
+				if at > len(row) {
+					continue
+				}
+				grid[r] = append(row[:at], append(make([]fakeCell, n), row[at:]...)...)
+			}
+		}
+		f.sheets[sheet] = grid
+
+	case req.DeleteDimension != nil:
+		dr := req.DeleteDimension.Range
+		sheet, err := f.sheetByID(dr.SheetId)
+		if err != nil {
+			return err
+		}
+		grid := f.sheets[sheet]
+		start, end := int(dr.StartIndex), int(dr.EndIndex)
+		if dr.Dimension == "ROWS" {
+			if start < len(grid) {
+				if end > len(grid) {
+					end = len(grid)
+				}
+				grid = append(grid[:start], grid[end:]...)
+			}
+		} else {
+			for r, row := range grid {
+				if start >= len(row) {
+					continue
+				}
+				e := end
+				if e > len(row) {
+					e = len(row)
+				}
+				grid[r] = append(row[:start], row[e:]...)
+			}
+		}
+		f.sheets[sheet] = grid
+
+	case req.CopyPaste != nil:
+		src, dst := req.CopyPaste.Source, req.CopyPaste.Destination
+		sheet, err := f.sheetByID(src.SheetId)
+		if err != nil {
+			return err
+		}
+		grid := f.sheets[sheet]
+		rowOffset := int(dst.StartRowIndex - src.StartRowIndex)
+		colOffset := int(dst.StartColumnIndex - src.StartColumnIndex)
+		for r := range grid {
+			for c := range grid[r] {
+				if !inFakeGridRange(src, c, r) {
+					continue
+				}
+				from := grid[r][c]
+				f.grow(sheet, c+colOffset, r+rowOffset)
+				to := &f.sheets[sheet][r+rowOffset][c+colOffset]
+				switch req.CopyPaste.PasteType {
+				case "PASTE_FORMAT":
+					to.format = from.format
+				case "PASTE_FORMULA": // Like Sheets, plain values are pasted too
+					to.value, to.formula = from.value, from.formula
+				default:
+					return fmt.Errorf("paste type %q not implemented by fake", req.CopyPaste.PasteType)
+				}
+			}
+		}
+
+	default:
+		return fmt.Errorf("request not implemented by fake")
+	}
+	return nil
+}
+
+func (f *fakeSheets) sheetByID(id int64) (string, error) {
+	for title, sheetID := range f.sheetIDs {
+		if sheetID == id {
+			return title, nil
+		}
+	}
+	return "", fmt.Errorf("no sheet with ID %d", id)
+}
+
+// inFakeGridRange tells if a zero based cell is in a grid range, where
+// unset end indexes are unbounded
+func inFakeGridRange(g *sheets.GridRange, col, row int) bool {
+	return int64(col) >= g.StartColumnIndex && (g.EndColumnIndex == 0 || int64(col) < g.EndColumnIndex) &&
+		int64(row) >= g.StartRowIndex && (g.EndRowIndex == 0 || int64(row) < g.EndRowIndex)
+}
+
+func transposeFakeGrid(grid [][]fakeCell) [][]fakeCell {
+	var t [][]fakeCell
+	for r, row := range grid {
+		for c, cell := range row {
+			for len(t) <= c {
+				t = append(t, nil)
+			}
+			for len(t[c]) <= r {
+				t[c] = append(t[c], fakeCell{})
+			}
+			t[c][r] = cell
+		}
+	}
+	return t
+}
+
+// parseRange splits an A1 notation range into a sheet name and zero
+// based bounds, where -1 marks an open ended row or column.
+func (f *fakeSheets) parseRange(rng string) (sheet string, c0, r0, c1, r1 int) {
+	sheet = ""
+	if i := strings.LastIndex(rng, "!"); i >= 0 {
+		sheet = strings.Trim(rng[:i], "'")
+		rng = rng[i+1:]
+	}
+	parts := strings.SplitN(rng, ":", 2)
+	c0, r0 = parseA1Cell(parts[0])
+	if c0 < 0 {
+		c0 = 0
+	}
+	if r0 < 0 {
+		r0 = 0
+	}
+	c1, r1 = c0, r0
+	if len(parts) == 2 {
+		c1, r1 = parseA1Cell(parts[1])
+	}
+	return sheet, c0, r0, c1, r1
+}
+
+// parseA1Cell converts i.e "AB12" to zero based column 27 and row 11.
+// A missing column or row is returned as -1.
+func parseA1Cell(cell string) (col, row int) {
+	i := 0
+	for i < len(cell) && cell[i] >= 'A' && cell[i] <= 'Z' {
+		col = col*26 + int(cell[i]-'A'+1)
+		i++
+	}
+	row, err := strconv.Atoi(cell[i:])
+	if err != nil {
+		row = 0
+	}
+	return col - 1, row - 1
+}
+
+func renderFakeCell(cell fakeCell, renderOption string) interface{} {
+	if renderOption == "FORMULA" && cell.formula != "" {
+		return cell.formula
+	}
+	switch v := cell.value.(type) {
+	case nil:
+		if cell.formula != "" {
+			return cell.formula
+		}
+		return ""
+	case float64:
+		if renderOption == "UNFORMATTED_VALUE" || renderOption == "FORMULA" {
+			return v
+		}
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if renderOption == "UNFORMATTED_VALUE" || renderOption == "FORMULA" {
+			return v
+		}
+		return strings.ToUpper(strconv.FormatBool(v))
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func decodeFakeBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeFakeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func writeFakeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeFakeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"message": message,
+		},
+	})
+}
@@ -3,13 +3,18 @@ module github.com/sonde/kpi-uploader
 go 1.13
 
 require (
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/lib/pq v1.3.0
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/prometheus/client_golang v1.5.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/sirupsen/logrus v1.5.0
 	github.com/sonde/logger v0.0.0-20200220123349-b9622c7910ba
 	github.com/takuoki/clmconv v1.0.0
 	github.com/tidwall/gjson v1.6.0
 	golang.org/x/net v0.0.0-20200324143707-d3edc9973b7e
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/text v0.3.2
 	google.golang.org/api v0.21.0
 	gopkg.in/yaml.v2 v2.2.8
 )
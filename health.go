@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syncHealth is the state reported by the readiness, liveness and health checks
+type syncHealth struct {
+	mu sync.Mutex
+
+	configured   bool // The config has been parsed
+	connected    bool // The spreadsheet has accepted our credentials
+	started      time.Time
+	runningSince time.Time // Zero when no sync is running
+	lastRun      time.Time
+	lastSuccess  time.Time
+	lastErrors   map[string]string // Last error per KPI or datapoint title
+	runError     string
+	maxStaleness time.Duration // Zero disables the staleness check
+}
+
+// healthReport is the JSON body of the health endpoint
+type healthReport struct {
+	Status       string            `json:"status"`
+	Ready        bool              `json:"ready"`
+	LastRun      *time.Time        `json:"lastRun,omitempty"`
+	LastSuccess  *time.Time        `json:"lastSuccess,omitempty"`
+	Staleness    string            `json:"staleness"`
+	MaxStaleness string            `json:"maxStaleness,omitempty"`
+	RunError     string            `json:"runError,omitempty"`
+	Errors       map[string]string `json:"errors,omitempty"`
+}
+
+var health = newSyncHealth()
+
+func newSyncHealth() *syncHealth {
+	return &syncHealth{
+		started:    time.Now(),
+		lastErrors: make(map[string]string),
+	}
+}
+
+// setConfigured marks the config as parsed, with the staleness threshold
+// for the health check.
+func (h *syncHealth) setConfigured(maxStaleness time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.configured = true
+	h.maxStaleness = maxStaleness
+}
+
+// setConnected marks the spreadsheet as reachable with our credentials
+func (h *syncHealth) setConnected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = true
+}
+
+// runStarted marks the start of a sync run
+func (h *syncHealth) runStarted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runningSince = time.Now()
+}
+
+// runFinished records the outcome of a sync run
+func (h *syncHealth) runFinished(summary *runSummary) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.runningSince = time.Time{}
+	h.lastRun = time.Now()
+	for _, title := range summary.Synced {
+		delete(h.lastErrors, title)
+	}
+	for title, errs := range summary.Errors {
+		h.lastErrors[title] = errs[len(errs)-1].Error()
+	}
+	h.runError = ""
+	if summary.Err != nil {
+		h.runError = summary.Err.Error()
+	}
+
+	// Any KPI synced means the sync works and the spreadsheet is reachable,
+	// the KPIs which failed are reported by their errors
+	if len(summary.Synced) > 0 {
+		h.lastSuccess = h.lastRun
+		h.connected = true
+	}
+}
+
+// isConnected tells if the spreadsheet has been reachable
+func (h *syncHealth) isConnected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.connected
+}
+
+// ready tells if the config is parsed and the spreadsheet is reachable
+func (h *syncHealth) ready() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.configured && h.connected
+}
+
+// stuck tells if a sync has been running for longer than the staleness threshold
+func (h *syncHealth) stuck(now time.Time) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.maxStaleness > 0 && !h.runningSince.IsZero() &&
+		now.Sub(h.runningSince) > h.maxStaleness
+}
+
+// report returns the health report, and false if the last sync where a KPI
+// synced is older than the staleness threshold. Until the first successful
+// sync, staleness is counted from startup.
+func (h *syncHealth) report(now time.Time) (healthReport, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	since := h.started
+	r := healthReport{
+		Status:   "ok",
+		Ready:    h.configured && h.connected,
+		RunError: h.runError,
+	}
+	if !h.lastRun.IsZero() {
+		lastRun := h.lastRun
+		r.LastRun = &lastRun
+	}
+	if !h.lastSuccess.IsZero() {
+		lastSuccess := h.lastSuccess
+		r.LastSuccess = &lastSuccess
+		since = lastSuccess
+	}
+	staleness := now.Sub(since)
+	r.Staleness = staleness.Round(time.Second).String()
+	if len(h.lastErrors) > 0 {
+		r.Errors = make(map[string]string, len(h.lastErrors))
+		for title, err := range h.lastErrors {
+			r.Errors[title] = err
+		}
+	}
+
+	healthy := true
+	if h.maxStaleness > 0 {
+		r.MaxStaleness = h.maxStaleness.String()
+		if staleness > h.maxStaleness {
+			r.Status = "stale"
+			healthy = false
+		}
+	}
+	return r, healthy
+}
+
+func isHealthy(w http.ResponseWriter, r *http.Request) {
+	report, healthy := health.report(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logit.WithFields(log.Fields{
+			"error": err,
+		}).Error("responding with health")
+	}
+}
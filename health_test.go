@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSyncHealthReport(t *testing.T) {
+	h := newSyncHealth()
+	h.setConfigured(time.Hour)
+	if _, healthy := h.report(time.Now()); !healthy {
+		t.Error("want healthy right after startup")
+	}
+
+	broken := newRunSummary()
+	broken.failed("Bad KPI", errors.New("command failed"))
+	h.runFinished(broken)
+
+	report, healthy := h.report(time.Now().Add(2 * time.Hour))
+	if healthy || report.Status != "stale" {
+		t.Errorf("got status %q, want stale when no KPI has synced", report.Status)
+	}
+
+	partial := newRunSummary()
+	partial.synced("Good KPI")
+	partial.failed("Bad KPI", errors.New("command failed"))
+	h.runFinished(partial)
+
+	report, healthy = h.report(time.Now())
+	if !healthy || report.LastSuccess == nil {
+		t.Errorf("got %+v, want healthy when a KPI synced", report)
+	}
+	if report.Errors["Bad KPI"] != "command failed" || len(report.Errors) != 1 {
+		t.Errorf("errors = %v, want the Bad KPI error only", report.Errors)
+	}
+	if !h.ready() {
+		t.Error("want ready when a KPI synced, even if another failed")
+	}
+
+	ok := newRunSummary()
+	ok.synced("Bad KPI")
+	h.runFinished(ok)
+
+	report, healthy = h.report(time.Now())
+	if !healthy || len(report.Errors) != 0 {
+		t.Errorf("got %+v, want healthy without errors", report)
+	}
+}
+
+func TestSyncHealthStuck(t *testing.T) {
+	h := newSyncHealth()
+	h.setConfigured(time.Minute)
+	h.runStarted()
+
+	if h.stuck(time.Now()) {
+		t.Error("a sync that just started is not stuck")
+	}
+	if !h.stuck(time.Now().Add(time.Hour)) {
+		t.Error("want a sync running for an hour to be stuck")
+	}
+}
+
+func TestIsReady(t *testing.T) {
+	defer func(h *syncHealth) { health = h }(health)
+	health = newSyncHealth()
+
+	rec := httptest.NewRecorder()
+	isReady(rec, httptest.NewRequest(http.MethodGet, "/_/ready", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d before config and connection, want 503", rec.Code)
+	}
+
+	health.setConfigured(0)
+	health.setConnected()
+	rec = httptest.NewRecorder()
+	isReady(rec, httptest.NewRequest(http.MethodGet, "/_/ready", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got %d, want 200", rec.Code)
+	}
+}
+
+func TestRunSyncPingsUntilConnected(t *testing.T) {
+	defer func(h *syncHealth) { health = h }(health)
+	health = newSyncHealth()
+	health.setConfigured(0)
+
+	fake := newFakeSheets(t)
+	defer fake.Close()
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "Broken", KPICommand: "false"}}
+
+	runSync(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if !health.ready() {
+		t.Error("want ready once the spreadsheet is reachable, despite the failed KPI")
+	}
+}
+
+func TestIsHealthy(t *testing.T) {
+	defer func(h *syncHealth) { health = h }(health)
+	health = newSyncHealth()
+	health.setConfigured(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	isHealthy(rec, httptest.NewRequest(http.MethodGet, "/_/health", nil))
+
+	var report healthReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+	}
+	if rec.Code != http.StatusServiceUnavailable || report.Status != "stale" {
+		t.Errorf("got %d %q, want 503 stale", rec.Code, report.Status)
+	}
+}
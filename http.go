@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultHTTPTimeout limits a request to an HTTP source
+const defaultHTTPTimeout = 30 * time.Second
+
+// HTTPRequest holds how to call an HTTP source. The body, headers and
+// credentials can use ${VAR} for an environment variable and
+// ${file:/path} for the contents of a secret file.
+type HTTPRequest struct {
+	Method      string            `yaml:"method"` // GET by default
+	Body        string            `yaml:"body"`
+	Headers     map[string]string `yaml:"headers"`
+	Username    string            `yaml:"username"` // Basic auth
+	Password    string            `yaml:"password"`
+	BearerToken string            `yaml:"bearer-token"`
+	CAFile      string            `yaml:"ca-file"`   // Trust this CA instead of the system ones
+	CertFile    string            `yaml:"cert-file"` // Client certificate for mTLS, with key-file
+	KeyFile     string            `yaml:"key-file"`
+	Timeout     string            `yaml:"timeout"` // Default "30s"
+}
+
+// validate checks the request options, a nil request is a plain GET
+func (r *HTTPRequest) validate() error {
+	if r == nil {
+		return nil
+	}
+	switch strings.ToUpper(r.Method) {
+	case "", http.MethodGet, http.MethodPost, http.MethodPut:
+	default:
+		return fmt.Errorf("method %q is not GET, POST or PUT", r.Method)
+	}
+	if r.Timeout != "" {
+		if d, err := time.ParseDuration(r.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("timeout %q is not a positive duration", r.Timeout)
+		}
+	}
+	if (r.CertFile == "") != (r.KeyFile == "") {
+		return fmt.Errorf("cert-file and key-file have to be set together")
+	}
+	if r.BearerToken != "" && (r.Username != "" || r.Password != "") {
+		return fmt.Errorf("use either bearer-token or username and password")
+	}
+	return nil
+}
+
+// fetch sends the request to uri and returns the status code and body,
+// whatever the status is
+func (r *HTTPRequest) fetch(uri string) (int, []byte, error) {
+	if r == nil {
+		r = &HTTPRequest{}
+	}
+	client, err := r.client()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	method := strings.ToUpper(r.Method)
+	if method == "" {
+		method = http.MethodGet
+	}
+	body, err := expandSecrets(r.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	req, err := http.NewRequest(method, uri, strings.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	for name, value := range r.Headers {
+		if value, err = expandSecrets(value); err != nil {
+			return 0, nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		req.Header.Set(name, value)
+	}
+	if r.Username != "" || r.Password != "" {
+		username, err := expandSecrets(r.Username)
+		if err != nil {
+			return 0, nil, err
+		}
+		password, err := expandSecrets(r.Password)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.SetBasicAuth(username, password)
+	}
+	if r.BearerToken != "" {
+		token, err := expandSecrets(r.BearerToken)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer func() { _ = response.Body.Close() }()
+	content, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, nil, fmt.Errorf("reading %s: %w", uri, err)
+	}
+	return response.StatusCode, content, nil
+}
+
+// get is fetch failing on a status other than 2xx
+func (r *HTTPRequest) get(uri string) ([]byte, error) {
+	status, body, err := r.fetch(uri)
+	if err != nil {
+		return nil, err
+	}
+	if status/100 != 2 {
+		return nil, fmt.Errorf("%s returned %d %s: %s", uri, status, http.StatusText(status), snippet(body))
+	}
+	return body, nil
+}
+
+// client returns an HTTP client with the timeout and TLS options
+func (r *HTTPRequest) client() (*http.Client, error) {
+	timeout := defaultHTTPTimeout
+	if r.Timeout != "" {
+		timeout, _ = time.ParseDuration(r.Timeout) // Checked by validate
+	}
+	client := &http.Client{Timeout: timeout}
+	if r.CAFile == "" && r.CertFile == "" {
+		return client, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if r.CAFile != "" {
+		pem, err := ioutil.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ca-file: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in ca-file %s", r.CAFile)
+		}
+	}
+	if r.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading cert-file and key-file: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	client.Transport = transport
+	return client, nil
+}
+
+// secretRef matches the ${VAR} and ${file:/path} references of expandSecrets
+var secretRef = regexp.MustCompile(`\$\{([^{}]+)\}`)
+
+// expandSecrets replaces ${VAR} with the environment variable and
+// ${file:/path} with the trimmed contents of the file, any other "$" is
+// kept as it is. An unset variable or unreadable file is an error.
+func expandSecrets(s string) (string, error) {
+	var err error
+	expanded := secretRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := secretRef.FindStringSubmatch(ref)[1]
+		if !strings.HasPrefix(name, "file:") {
+			value, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("secret variable %s is not set", name)
+			}
+			return value
+		}
+		content, readErr := ioutil.ReadFile(strings.TrimPrefix(name, "file:"))
+		if readErr != nil && err == nil {
+			err = fmt.Errorf("reading secret: %w", readErr)
+		}
+		return strings.TrimSpace(string(content))
+	})
+	return expanded, err
+}
+
+// snippet shortens a response body for an error message
+func snippet(body []byte) string {
+	s := strings.TrimSpace(string(body))
+	if len(s) > 200 {
+		s = s[:200] + "..."
+	}
+	return s
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTTPRequestAuthAndSecrets(t *testing.T) {
+	var got *http.Request
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		got, body = r, string(b)
+		fmt.Fprint(w, `{"data":{"count":12}}`)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kpi-uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(secretFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HTTP_TEST_TENANT", "team-a")
+	defer os.Unsetenv("HTTP_TEST_TENANT")
+
+	request := &HTTPRequest{
+		Method:   "post",
+		Body:     `{"tenant":"${HTTP_TEST_TENANT}","query":"query($id: ID!) { price(id: $id) }","max":"$5"}`,
+		Headers:  map[string]string{"X-Tenant": "${HTTP_TEST_TENANT}"},
+		Username: "kpi",
+		Password: "${file:" + secretFile + "}",
+	}
+	value, err := scrapeToJSON(srv.URL, "data.count", request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "12" {
+		t.Errorf("value = %q, want 12", value)
+	}
+	user, password, _ := got.BasicAuth()
+	if got.Method != http.MethodPost || body != `{"tenant":"team-a","query":"query($id: ID!) { price(id: $id) }","max":"$5"}` ||
+		got.Header.Get("X-Tenant") != "team-a" || user != "kpi" || password != "s3cret" {
+		t.Errorf("request = %s %q %v %s:%s", got.Method, body, got.Header, user, password)
+	}
+
+	request = &HTTPRequest{BearerToken: "${HTTP_TEST_TENANT}"}
+	if _, err := scrapeToJSON(srv.URL, "data.count", request); err != nil {
+		t.Fatal(err)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "Bearer team-a" {
+		t.Errorf("Authorization = %q, want the bearer token", auth)
+	}
+
+	request = &HTTPRequest{Password: "${file:" + filepath.Join(dir, "missing") + "}"}
+	if _, err := scrapeToJSON(srv.URL, "data.count", request); err == nil {
+		t.Error("missing secret file did not fail")
+	}
+
+	request = &HTTPRequest{BearerToken: "${HTTP_TEST_UNSET_TOKEN}"}
+	if _, err := scrapeToJSON(srv.URL, "data.count", request); err == nil ||
+		!strings.Contains(err.Error(), "HTTP_TEST_UNSET_TOKEN is not set") {
+		t.Errorf("unset secret variable gave %v", err)
+	}
+}
+
+func TestScrapeToJSONErrors(t *testing.T) {
+	status, body := http.StatusOK, `{"data":{"count":null}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	for _, picker := range []string{"data.count", "data.missing"} {
+		if _, err := scrapeToJSON(srv.URL, picker, nil); err == nil || !strings.Contains(err.Error(), "no value") {
+			t.Errorf("picking %s gave %v", picker, err)
+		}
+	}
+
+	status, body = http.StatusUnauthorized, `{"data":{"count":0}}`
+	if _, err := scrapeToJSON(srv.URL, "data.count", nil); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("unauthorized response gave %v", err)
+	}
+}
+
+func TestHTTPRequestTLS(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"value":1}`)
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "kpi-uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writePEM := func(name, kind string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// The test server certificate doubles as the client certificate
+	cert := srv.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := &HTTPRequest{
+		CAFile:   writePEM("ca.pem", "CERTIFICATE", srv.Certificate().Raw),
+		CertFile: writePEM("cert.pem", "CERTIFICATE", cert.Certificate[0]),
+		KeyFile:  writePEM("key.pem", "PRIVATE KEY", key),
+	}
+	if value, err := scrapeToJSON(srv.URL, "value", request); err != nil || value != "1" {
+		t.Errorf("value = %q, %v, want 1", value, err)
+	}
+
+	request.CertFile, request.KeyFile = "", ""
+	if _, err := scrapeToJSON(srv.URL, "value", request); err == nil {
+		t.Error("request without a client certificate did not fail")
+	}
+	if _, err := scrapeToJSON(srv.URL, "value", nil); err == nil {
+		t.Error("request without the CA did not fail")
+	}
+}
+
+func TestHTTPRequestValidate(t *testing.T) {
+	for _, test := range []struct {
+		request HTTPRequest
+		want    string
+	}{
+		{HTTPRequest{Method: "DELETE"}, "method"},
+		{HTTPRequest{Timeout: "soon"}, "timeout"},
+		{HTTPRequest{CertFile: "cert.pem"}, "key-file"},
+		{HTTPRequest{BearerToken: "t", Username: "u"}, "bearer-token"},
+	} {
+		if err := test.request.validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate %+v = %v, want %q", test.request, err, test.want)
+		}
+	}
+	if err := (&HTTPRequest{Method: "post", Timeout: "5s"}).validate(); err != nil {
+		t.Errorf("valid request: %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNearMisses is the number of sheet keys reported for a key missing
+// from the sheet
+const maxNearMisses = 3
+
+// KeyNormalization makes keys written differently in the sheet and in the
+// scraped data match. The steps are applied to both, in the order of the
+// fields, and to each part of a composite key.
+type KeyNormalization struct {
+	NFC      string       `yaml:"unicode-nfc"` // "yes" to compose Unicode characters, i.e "é" as a single rune
+	Trim     string       `yaml:"trim"`        // "yes" to remove surrounding space, and collapse inner space
+	CaseFold string       `yaml:"case-fold"`   // "yes" to ignore case
+	Rewrite  []KeyRewrite `yaml:"rewrite"`     // Regular expressions to replace, in order
+	Numbers  string       `yaml:"numbers"`     // "yes" to write numbers canonically, i.e "1.0" and "1,000" as "1" and "1000"
+}
+
+// KeyRewrite replaces the matches of a regular expression in keys, the
+// replacement can use $1 for submatches
+type KeyRewrite struct {
+	Pattern string `yaml:"pattern"`
+	Replace string `yaml:"replace"`
+}
+
+// keyNormalizer normalizes keys as configured by key-normalize, a nil
+// keyNormalizer keeps keys as they are
+type keyNormalizer struct {
+	steps    KeyNormalization
+	rewrites []*regexp.Regexp
+}
+
+// newKeyNormalizer returns the normalizer of key-normalize, or nil if it
+// is not set
+func newKeyNormalizer(cfg *Config) (*keyNormalizer, error) {
+	if cfg.KeyNormalize == nil {
+		return nil, nil
+	}
+	n := &keyNormalizer{steps: *cfg.KeyNormalize}
+	for _, option := range []struct{ key, value string }{
+		{"unicode-nfc", n.steps.NFC},
+		{"trim", n.steps.Trim},
+		{"case-fold", n.steps.CaseFold},
+		{"numbers", n.steps.Numbers},
+	} {
+		if option.value != "" && option.value != "yes" && option.value != "no" {
+			return nil, fmt.Errorf("key-normalize %s %q is not yes or no", option.key, option.value)
+		}
+	}
+	for _, rewrite := range n.steps.Rewrite {
+		re, err := regexp.Compile(rewrite.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("key-normalize rewrite %q: %w", rewrite.Pattern, err)
+		}
+		n.rewrites = append(n.rewrites, re)
+	}
+	return n, nil
+}
+
+// normalize returns the key as it is compared
+func (n *keyNormalizer) normalize(key string) string {
+	if n == nil {
+		return key
+	}
+	if n.steps.NFC == "yes" {
+		key = norm.NFC.String(key)
+	}
+	if n.steps.Trim == "yes" {
+		key = strings.Join(strings.Fields(key), " ")
+	}
+	if n.steps.CaseFold == "yes" {
+		key = cases.Fold().String(key)
+	}
+	for i, re := range n.rewrites {
+		key = re.ReplaceAllString(key, n.steps.Rewrite[i].Replace)
+	}
+	if n.steps.Numbers == "yes" {
+		key = canonicalNumber(key)
+	}
+	return key
+}
+
+var (
+	decimalNumber      = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)([eE]([-+]?\d+))?$`)
+	thousandsSeparated = regexp.MustCompile(`^[-+]?\d{1,3}(,\d{3})+(\.\d+)?$`)
+)
+
+// maxNumberDecimals limits the exponent and decimals of a numeric key, a
+// longer one is kept as it is
+const maxNumberDecimals = 1000
+
+// canonicalNumber returns a numeric key in its shortest exact form, other
+// keys are returned as they are
+func canonicalNumber(key string) string {
+	s := strings.TrimSpace(key)
+	if thousandsSeparated.MatchString(s) {
+		s = strings.Replace(s, ",", "", -1)
+	}
+	m := decimalNumber.FindStringSubmatch(s)
+	if m == nil {
+		return key
+	}
+
+	// The decimals needed for the exact value, from those written and the exponent
+	decimals := 0
+	if dot := strings.Index(m[1], "."); dot >= 0 {
+		decimals = len(m[1]) - dot - 1
+	}
+	if m[3] != "" {
+		exp, err := strconv.Atoi(m[3])
+		if err != nil || exp > maxNumberDecimals || exp < -maxNumberDecimals {
+			return key
+		}
+		decimals -= exp
+	}
+	if decimals > maxNumberDecimals {
+		return key
+	}
+	if decimals < 0 {
+		decimals = 0
+	}
+
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return key
+	}
+	text := r.FloatString(decimals)
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(strings.TrimRight(text, "0"), ".")
+	}
+	if text == "-0" {
+		text = "0"
+	}
+	return text
+}
+
+// nearMisses returns the sheet keys closest to a key missing from the
+// sheet: keys equal to it when ignoring case, space and punctuation, or else
+// within an edit or two, closest first.
+func nearMisses(key string, sheetKeys []string) []string {
+	loose := looseKey(key)
+	if loose == "" {
+		return nil
+	}
+	maxEdits := 1
+	if len([]rune(loose)) >= 8 {
+		maxEdits = 2
+	}
+
+	type candidate struct {
+		key   string
+		edits int
+	}
+	var candidates []candidate
+	for _, sheetKey := range sheetKeys {
+		if sheetKey == key {
+			continue
+		}
+		if edits := editDistance(loose, looseKey(sheetKey)); edits <= maxEdits {
+			candidates = append(candidates, candidate{sheetKey, edits})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].edits != candidates[j].edits {
+			return candidates[i].edits < candidates[j].edits
+		}
+		return candidates[i].key < candidates[j].key
+	})
+	var keys []string
+	for i := 0; i < len(candidates) && i < maxNearMisses; i++ {
+		keys = append(keys, candidates[i].key)
+	}
+	return keys
+}
+
+// looseKey returns the letters and digits of a key, case folded, with
+// numbers written canonically
+func looseKey(key string) string {
+	key = cases.Fold().String(norm.NFKC.String(canonicalNumber(key)))
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, key)
+}
+
+// editDistance returns the Levenshtein distance between two strings, in runes
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
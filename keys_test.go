@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyNormalizer(t *testing.T) {
+	for _, test := range []struct {
+		steps KeyNormalization
+		key   string
+		want  string
+	}{
+		{KeyNormalization{NFC: "yes"}, "café", "café"},
+		{KeyNormalization{Trim: "yes"}, "  My \t App ", "My App"},
+		{KeyNormalization{CaseFold: "yes"}, "MyApp", "myapp"},
+		{KeyNormalization{Numbers: "yes"}, "1.0", "1"},
+		{KeyNormalization{Numbers: "yes"}, "1,000.50", "1000.5"},
+		{KeyNormalization{Numbers: "yes"}, "1e3", "1000"},
+		{KeyNormalization{Numbers: "yes"}, "-0.0", "0"},
+		{KeyNormalization{Numbers: "yes"}, "2.50e-3", "0.0025"},
+		{KeyNormalization{Numbers: "yes"}, "12345678901234567.1", "12345678901234567.1"},
+		{KeyNormalization{Numbers: "yes"}, "12345678901234567.2", "12345678901234567.2"},
+		{KeyNormalization{Numbers: "yes"}, "0.10000000000000000001", "0.10000000000000000001"},
+		{KeyNormalization{Numbers: "yes"}, "1e99999", "1e99999"},
+		{KeyNormalization{Numbers: "yes"}, "v1.0", "v1.0"},
+		{KeyNormalization{Numbers: "yes"}, "1/3", "1/3"},
+		{KeyNormalization{Rewrite: []KeyRewrite{{Pattern: `^(.*)-prod$`, Replace: "$1"}}}, "web-prod", "web"},
+		{KeyNormalization{Trim: "yes", CaseFold: "yes", Rewrite: []KeyRewrite{{Pattern: `^app `, Replace: ""}}}, " App  2.0", "2.0"},
+		{KeyNormalization{Trim: "yes", Rewrite: []KeyRewrite{{Pattern: `^app-`, Replace: ""}}, Numbers: "yes"}, "app-2.0 ", "2"},
+	} {
+		normalizer, err := newKeyNormalizer(&Config{KeyNormalize: &test.steps})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := normalizer.normalize(test.key); got != test.want {
+			t.Errorf("normalize %q with %+v = %q, want %q", test.key, test.steps, got, test.want)
+		}
+	}
+
+	var normalizer *keyNormalizer
+	if got := normalizer.normalize(" MyApp "); got != " MyApp " {
+		t.Errorf("nil normalizer changed the key to %q", got)
+	}
+	for _, steps := range []KeyNormalization{
+		{Trim: "true"},
+		{Rewrite: []KeyRewrite{{Pattern: "("}}},
+	} {
+		if _, err := newKeyNormalizer(&Config{KeyNormalize: &steps}); err == nil {
+			t.Errorf("invalid %+v gave no error", steps)
+		}
+	}
+}
+
+func TestNearMisses(t *testing.T) {
+	sheetKeys := []string{"MyApp", "myapp2", "other", "my-application", "1.0"}
+	for key, want := range map[string][]string{
+		"my-app":          {"MyApp", "myapp2"},
+		"my applications": {"my-application"},
+		"1":               {"1.0"},
+		"unknown":         nil,
+		"--":              nil,
+	} {
+		if got := nearMisses(key, sheetKeys); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("near misses of %q = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesKeyNormalize(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"App1 "},
+		[]interface{}{"APP2"},
+		[]interface{}{"unknow"})
+	cfg := datapointTestConfig()
+
+	// Without normalization the keys miss, and are reported as near misses
+	summary := updateGoogleSheetValues(cfg, fake.sink())
+	var misses []string
+	for _, m := range summary.NearMisses {
+		misses = append(misses, fmt.Sprintf("%s:%s", m.Key, quoteKeys(m.SheetKeys)))
+	}
+	if got, want := strings.Join(misses, " "), `app1:"App1 ", "APP2" app2:"APP2", "App1 " unknown:"unknow"`; got != want {
+		t.Errorf("near misses %s, want %s", got, want)
+	}
+	if got := fake.get("Deployments", "B2"); got != nil {
+		t.Errorf("cell B2 = %v without normalization", got)
+	}
+
+	cfg.KeyNormalize = &KeyNormalization{Trim: "yes", CaseFold: "yes"}
+	summary = updateGoogleSheetValues(cfg, fake.sink())
+	if summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{"B2": 3.0, "B3": 5.0, "B4": nil} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIKeyNormalize(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "Open incidents", KPICommand: "echo", KPICommandArgs: "4"}}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", currentWeek()},
+		[]interface{}{"", "", "Open Incidents "})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if errs := summary.Errors["Open incidents"]; len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), `near keys in the sheet: "Open Incidents "`) {
+		t.Errorf("missing KPI row gave %v, want the near miss", errs)
+	}
+
+	cfg.KeyNormalize = &KeyNormalization{Trim: "yes", CaseFold: "yes"}
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()}); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	if got := fake.get("KPI data", "D3"); got != 4.0 {
+		t.Errorf("cell D3 = %v, want 4", got)
+	}
+}
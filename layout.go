@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/takuoki/clmconv"
+)
+
+// maxPeriodLookback is how many periods back addPeriodColumn looks for the
+// previous period column
+const maxPeriodLookback = 1000
+
+// addPeriodColumn adds the missing column for the period holding at, with
+// its topic in the topic row, and returns its column letter. It is either
+// appended after the last topic, or with add-period-column "insert" placed
+// after the latest earlier period column. The formats and formulas of that
+// period column are copied into it. A dry run only plans the topic.
+func addPeriodColumn(cfg *Config, sink Sink, periods *periodFormat, at time.Time, plan *syncPlan) (string, error) {
+	topic := periods.topic(at)
+	topics, err := sink.LookupTopic(cfg.SheetName, cfg.SheetTopicRow)
+	if err != nil {
+		return "", fmt.Errorf("read topic row %s of %s: %w", cfg.SheetTopicRow, cfg.SheetName, err)
+	}
+	columns := make(map[string]int)
+	for col, t := range topics {
+		if _, ok := columns[fmt.Sprintf("%v", t)]; !ok {
+			columns[fmt.Sprintf("%v", t)] = col
+		}
+	}
+	if col, ok := columns[topic]; ok {
+		return clmconv.Itoa(col), nil // Added since we looked
+	}
+
+	// The latest earlier period column is copied, and with "insert" the
+	// new column is placed right after it
+	copyFrom := -1
+	previous := at
+	for i := 0; i < maxPeriodLookback; i++ {
+		previous = periods.previous(previous)
+		if col, ok := columns[periods.topic(previous)]; ok {
+			copyFrom = col
+			break
+		}
+	}
+	index := len(topics)
+	if cfg.AddPeriodColumn == "insert" && copyFrom >= 0 {
+		index = copyFrom + 1
+	}
+	letter := clmconv.Itoa(index)
+	header := cfg.SheetName + "!" + letter + cfg.SheetTopicRow + ":" + letter + cfg.SheetTopicRow
+
+	if cfg.DryRun == "yes" {
+		plan.add("New period column", header, nil, topic)
+		return letter, nil
+	}
+
+	logit.WithFields(log.Fields{
+		"topic":  topic,
+		"column": letter,
+	}).Info("Adding period column")
+	if err := sink.InsertDimension(cfg.SheetName, Columns, index, copyFrom); err != nil {
+		return "", fmt.Errorf("add column %s for topic %q: %w", letter, topic, err)
+	}
+	if err := sink.WriteRange(header, [][]interface{}{{topic}}); err != nil {
+		return "", fmt.Errorf("set topic %q in %s: %w", topic, header, err)
+	}
+	return letter, nil
+}
+
+// kpiRow is where a KPI is in the sheet
+type kpiRow struct {
+	row   int  // One based row number
+	added bool // Added by this run, or planned by a dry run
+	err   error
+}
+
+// kpiRows locates the row of each KPI, by its sheet-row or by its title in
+// the key column. With add-kpi-rows set, a missing row is added, either
+// appended after the last key, or with "insert" placed after the row of
+// the KPI before it. The new row gets the title, and the formats and
+// formulas of the row above. A row is not added above rows given by
+// sheet-row, which would move them.
+func kpiRows(cfg *Config, sink Sink, kpis []KPIs) []kpiRow {
+	rows := make([]kpiRow, len(kpis))
+
+	// Rows given by sheet-row need no lookup
+	lookup := false
+	for i, kpi := range kpis {
+		if kpi.SheetRow != "" {
+			rows[i].row, _ = strconv.Atoi(kpi.SheetRow) // Checked by validateConfig
+		} else {
+			lookup = true
+		}
+	}
+	if !lookup {
+		return rows
+	}
+
+	// Keys start at sheet-data-start-row, or right below the topics
+	startRow, err := strconv.Atoi(cfg.SheetDataStartRow)
+	if err != nil {
+		topicRow, _ := strconv.Atoi(cfg.SheetTopicRow)
+		startRow = topicRow + 1
+	}
+	normalizer, err := newKeyNormalizer(cfg)
+	var keys [][]interface{}
+	if err == nil {
+		keys, err = lookupKeys(sink, cfg.SheetName, []string{cfg.SheetKeyCol}, startRow, normalizer)
+		if err != nil {
+			err = fmt.Errorf("read key column %s of %s: %w", cfg.SheetKeyCol, cfg.SheetName, err)
+		}
+	}
+	if err != nil {
+		for i := range rows {
+			if rows[i].row == 0 {
+				rows[i].err = err
+			}
+		}
+		return rows
+	}
+	keyRows := make(map[string]int)
+	var sheetKeys []string
+	lastRow := startRow - 1
+	for i, key := range keys {
+		if len(key) > 0 && key[0] != "" {
+			if _, ok := keyRows[fmt.Sprintf("%v", key[0])]; !ok {
+				keyRows[fmt.Sprintf("%v", key[0])] = startRow + i
+				sheetKeys = append(sheetKeys, fmt.Sprintf("%v", key[0]))
+			}
+			lastRow = startRow + i
+		}
+	}
+
+	for i, kpi := range kpis {
+		if rows[i].row != 0 {
+			continue
+		}
+		if row, ok := keyRows[normalizer.normalize(kpi.Title)]; ok {
+			rows[i].row = row
+			continue
+		}
+		if cfg.AddKPIRows == "" {
+			rows[i].err = fmt.Errorf("FIX: Add a new row for key %q in %s!%s, or set sheet-row",
+				kpi.Title, cfg.SheetName, cfg.SheetKeyCol)
+			if candidates := nearMisses(normalizer.normalize(kpi.Title), sheetKeys); len(candidates) > 0 {
+				rows[i].err = fmt.Errorf("%w, near keys in the sheet: %s", rows[i].err, quoteKeys(candidates))
+			}
+			continue
+		}
+
+		// Place the row after the last key and the rows of the other KPIs,
+		// or after the KPI before it
+		row := lastRow + 1
+		for _, r := range rows {
+			if r.row >= row {
+				row = r.row + 1
+			}
+		}
+		if cfg.AddKPIRows == "insert" {
+			for j := i - 1; j >= 0; j-- {
+				if rows[j].row != 0 {
+					row = rows[j].row + 1
+					break
+				}
+			}
+		}
+
+		// Rows given by sheet-row can not move, as their sheet-row would
+		// then point at the row above
+		var moved []string
+		seen := make(map[string]bool)
+		for _, k := range append(append([]KPIs{}, kpis...), cfg.KPI...) {
+			if n, _ := strconv.Atoi(k.SheetRow); n >= row && !seen[k.Title] {
+				seen[k.Title] = true
+				moved = append(moved, fmt.Sprintf("%q from %d to %d", k.Title, n, n+1))
+			}
+		}
+		if len(moved) > 0 {
+			rows[i].err = fmt.Errorf("FIX: Add a new row for key %q in %s!%s, adding row %d moves the rows given by sheet-row, update sheet-row of %s",
+				kpi.Title, cfg.SheetName, cfg.SheetKeyCol, row, strings.Join(moved, ", "))
+			continue
+		}
+
+		if err := addKPIRow(cfg, sink, kpi.Title, row, startRow); err != nil {
+			rows[i].err = err
+			continue
+		}
+
+		// Rows below the new one moved down, which a dry run only plans,
+		// so it keeps reading them where they are now
+		if cfg.DryRun != "yes" {
+			for j := range rows {
+				if rows[j].row >= row {
+					rows[j].row++
+				}
+			}
+			for key, r := range keyRows {
+				if r >= row {
+					keyRows[key] = r + 1
+				}
+			}
+		}
+		if lastRow < row {
+			lastRow = row
+		} else if cfg.DryRun != "yes" {
+			lastRow++
+		}
+		rows[i] = kpiRow{row: row, added: true}
+	}
+	return rows
+}
+
+// addKPIRow inserts a row for a KPI at a one based row number, with its
+// title in the key column. A dry run only logs it.
+func addKPIRow(cfg *Config, sink Sink, title string, row, startRow int) error {
+	logit.WithFields(log.Fields{
+		"kpi": title,
+		"row": row,
+	}).Info("Adding KPI row")
+	if cfg.DryRun == "yes" {
+		return nil
+	}
+
+	copyFrom := row - 2 // The zero based index of the row above
+	if row-1 < startRow {
+		copyFrom = -1 // Do not copy the topic or other header rows
+	}
+	if err := sink.InsertDimension(cfg.SheetName, Rows, row-1, copyFrom); err != nil {
+		return fmt.Errorf("add row %d for %q: %w", row, title, err)
+	}
+	cell := fmt.Sprintf("%s!%s%d", cfg.SheetName, cfg.SheetKeyCol, row)
+	if err := sink.WriteRange(cell, [][]interface{}{{title}}); err != nil {
+		return fmt.Errorf("set title %q in %s: %w", title, cell, err)
+	}
+	return nil
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpdateGoogleSheetKPIAddsPeriodColumn(t *testing.T) {
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC) // Week 2020-07
+	for _, test := range []struct {
+		add    string
+		column string
+	}{
+		{"append", "G"},
+		{"insert", "E"},
+	} {
+		t.Run(test.add, func(t *testing.T) {
+			fake := newFakeSheets(t)
+			defer fake.Close()
+
+			cfg := kpiTestConfig()
+			cfg.AddPeriodColumn = test.add
+			cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "7"}}
+			fake.set("KPI data", "A2",
+				[]interface{}{"", "Last update", "KPI", "2020-06", "Notes", "2020-09"},
+				[]interface{}{"", "2020-02-06", "KPI", 6})
+			if err := fake.sink().WriteRange("KPI data!A4:F4",
+				[][]interface{}{{"", "", "Total", "=SUM(D3:D3)", "", "=SUM(F3:F3)"}}); err != nil {
+				t.Fatal(err)
+			}
+			fake.set("KPI data", "C5", []interface{}{"Comment", "constant", "", "constant"})
+			fake.setFormat("KPI data", "D4", "bold")
+			fake.setFormat("KPI data", "F4", "bold")
+
+			summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at})
+			if summary.Failed() {
+				t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+			}
+
+			c := test.column
+			if got := fake.get("KPI data", c+"2"); got != "2020-07" {
+				t.Errorf("topic %s2 = %v, want 2020-07", c, got)
+			}
+			if got := fake.get("KPI data", c+"3"); got != 7.0 {
+				t.Errorf("value %s3 = %v, want 7", c, got)
+			}
+			if got := fake.cell("KPI data", c+"4"); got.formula == "" || got.format != "bold" {
+				t.Errorf("cell %s4 = %+v, want the formula and format copied", c, got)
+			}
+			if got := fake.get("KPI data", c+"5"); got != nil {
+				t.Errorf("cell %s5 = %v, want the copied value cleared", c, got)
+			}
+		})
+	}
+}
+
+func TestUpdateGoogleSheetKPIAppendsPeriodColumnAfterNotes(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.AddPeriodColumn = "append"
+	cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "7"}}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", "2020-06", "Notes"},
+		[]interface{}{"", "2020-02-06", "KPI", 6, "Some note"})
+	fake.setFormula("KPI data", "D4", "=SUM(D3:D3)", 6.0)
+	fake.setFormat("KPI data", "D4", "bold")
+	fake.setFormat("KPI data", "E4", "italic")
+
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC) // Week 2020-07
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at}); summary.Failed() {
+		t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+	}
+	if got := fake.get("KPI data", "F2"); got != "2020-07" {
+		t.Errorf("topic F2 = %v, want 2020-07", got)
+	}
+	if got := fake.cell("KPI data", "F4"); got.formula == "" || got.format != "bold" {
+		t.Errorf("cell F4 = %+v, want the formula and format of the 2020-06 column", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIInsertsPeriodColumnAfterPrevious(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.AddPeriodColumn = "insert"
+	cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "7"}}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", "2020-05", "2020-09"},
+		[]interface{}{"", "2020-02-06", "KPI", 5, 9})
+
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC) // Week 2020-07, 2020-06 is missing too
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at}); summary.Failed() {
+		t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+	}
+
+	for cell, want := range map[string]interface{}{
+		"E2": "2020-07", "E3": 7.0, // Inserted after 2020-05, values not copied
+		"F2": "2020-09", "F3": 9, // Moved one column right
+	} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIPlansPeriodColumn(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.DryRun = "yes"
+	cfg.AddPeriodColumn = "insert"
+	cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "7"}}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", "2020-06", "2020-09"},
+		[]interface{}{"", time.Now().Format("2006-01-02"), "KPI", 6, 9})
+
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC)
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at})
+
+	want := []plannedChange{
+		{Cell: "KPI data!E2", Title: "New period column", Old: "", New: "2020-07"},
+		{Cell: "KPI data!E3", Title: "KPI", Old: "", New: int64(7)},
+	}
+	if len(summary.Plan.Changes) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", summary.Plan.Changes, want)
+	}
+	for i, c := range summary.Plan.Changes {
+		if c != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+	if got := fake.get("KPI data", "E2"); got != "2020-09" {
+		t.Errorf("dry run changed the sheet, E2 = %v", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIFindsRowByTitle(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "B", KPICommand: "echo", KPICommandArgs: "2"},
+		{Title: "Missing", KPICommand: "echo", KPICommandArgs: "9"},
+	}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", currentWeek()},
+		[]interface{}{"", "", "A", 1},
+		[]interface{}{"", "", "B", 1})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if got := fake.get("KPI data", "D4"); got != 2.0 {
+		t.Errorf("value D4 = %v, want 2", got)
+	}
+	if err := summary.Errors["Missing"]; err == nil {
+		t.Errorf("missing row without add-kpi-rows did not fail, errors %v", summary.Errors)
+	}
+	if got := fake.get("KPI data", "C5"); got != nil {
+		t.Errorf("missing row was added, C5 = %v", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIAddsKPIRows(t *testing.T) {
+	for _, test := range []struct {
+		add   string
+		cells map[string]interface{}
+	}{
+		{"append", map[string]interface{}{
+			"C3": "A", "C4": "C", "C5": "Total", "C6": "B", "D6": 2.0, "D4": 3.0,
+		}},
+		{"insert", map[string]interface{}{
+			"C3": "A", "C4": "B", "D4": 2.0, "C5": "C", "D5": 3.0, "C6": "Total",
+		}},
+	} {
+		t.Run(test.add, func(t *testing.T) {
+			fake := newFakeSheets(t)
+			defer fake.Close()
+
+			cfg := kpiTestConfig()
+			cfg.AddKPIRows = test.add
+			cfg.KPI = []KPIs{
+				{Title: "A", KPICommand: "echo", KPICommandArgs: "1"},
+				{Title: "B", KPICommand: "echo", KPICommandArgs: "2"},
+				{Title: "C", KPICommand: "echo", KPICommandArgs: "3"},
+			}
+			fake.set("KPI data", "A2",
+				[]interface{}{"", "Last update", "KPI", currentWeek()},
+				[]interface{}{"", "", "A", 1},
+				[]interface{}{"", "", "C", 1})
+			if err := fake.sink().WriteRange("KPI data!C5:E5",
+				[][]interface{}{{"Total", "", "=D3+D4"}}); err != nil {
+				t.Fatal(err)
+			}
+			fake.setFormat("KPI data", "E3", "bold")
+
+			summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+			if summary.Failed() {
+				t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+			}
+			for cell, want := range test.cells {
+				if got := fake.get("KPI data", cell); got != want {
+					t.Errorf("cell %s = %v, want %v", cell, got, want)
+				}
+			}
+			row := "6"
+			if test.add == "insert" {
+				row = "4"
+			}
+			if got := fake.get("KPI data", "B"+row); got != time.Now().Format("2006-01-02") {
+				t.Errorf("last update B%s = %v, want today", row, got)
+			}
+			if test.add == "insert" {
+				if got := fake.cell("KPI data", "E4"); got.format != "bold" {
+					t.Errorf("cell E4 = %+v, want the format of the row above", got)
+				}
+			} else if got := fake.cell("KPI data", "E6"); got.formula == "" {
+				t.Errorf("cell E6 = %+v, want the formula of the row above", got)
+			}
+		})
+	}
+}
+
+func TestUpdateGoogleSheetKPIKeepsSheetRows(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.AddKPIRows = "insert"
+	cfg.KPI = []KPIs{
+		{Title: "A", KPICommand: "echo", KPICommandArgs: "1"},
+		{Title: "B", KPICommand: "echo", KPICommandArgs: "2"},
+		{Title: "Total", SheetRow: "5", KPICommand: "echo", KPICommandArgs: "9"},
+	}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", currentWeek()},
+		[]interface{}{"", "", "A", 1},
+		[]interface{}{"", "", "C", 3},
+		[]interface{}{"", "", "Total"})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if errs := summary.Errors["B"]; len(errs) != 1 ||
+		!strings.Contains(errs[0].Error(), `update sheet-row of "Total" from 5 to 6`) {
+		t.Errorf("inserting above a sheet-row gave %v", errs)
+	}
+	for cell, want := range map[string]interface{}{"C4": "C", "D4": 3, "C5": "Total", "D5": 9.0} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIAppendsKPIRowBelowSheetRows(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.AddKPIRows = "append"
+	cfg.KPI = []KPIs{
+		{Title: "Total", SheetRow: "10", KPICommand: "echo", KPICommandArgs: "9"},
+		{Title: "Subtotal", SheetRow: "8", KPICommand: "echo", KPICommandArgs: "8"},
+		{Title: "B", KPICommand: "echo", KPICommandArgs: "2"},
+	}
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", currentWeek()},
+		[]interface{}{"", "", "A", 1})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if summary.Failed() {
+		t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{"C11": "B", "D11": 2.0, "D10": 9.0, "D8": 8.0, "C9": nil} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIPlansKPIRow(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.DryRun = "yes"
+	cfg.AddKPIRows = "insert"
+	cfg.KPI = []KPIs{
+		{Title: "A", KPICommand: "echo", KPICommandArgs: "1"},
+		{Title: "B", KPICommand: "echo", KPICommandArgs: "2"},
+	}
+	today := time.Now().Format("2006-01-02")
+	fake.set("KPI data", "A2",
+		[]interface{}{"", "Last update", "KPI", currentWeek()},
+		[]interface{}{"", today, "A", 1},
+		[]interface{}{"", today, "C", 3})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+
+	want := []plannedChange{
+		{Cell: "KPI data!C4", Title: "B", Old: "", New: "B"},
+		{Cell: "KPI data!D4", Title: "B", Old: "", New: int64(2)},
+		{Cell: "KPI data!B4", Title: "B", Old: "", New: today},
+	}
+	if len(summary.Plan.Changes) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", summary.Plan.Changes, want)
+	}
+	for i, c := range summary.Plan.Changes {
+		if c != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+	if got := fake.get("KPI data", "C4"); got != "C" {
+		t.Errorf("dry run changed the sheet, C4 = %v", got)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quotaPeriod is the period Google meters the Sheets API quota over
+const quotaPeriod = 100 * time.Second
+
+// tokenBucket allows a number of requests per period. The full budget can
+// be used at once, after which requests are spread evenly over the period.
+type tokenBucket struct {
+	group string // Quota group for the wait metric, "read" or "write"
+
+	mu       sync.Mutex
+	rate     float64 // Tokens added per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+
+	now   func() time.Time    // Replaced in tests
+	sleep func(time.Duration) // Replaced in tests
+}
+
+func newTokenBucket(group string, requests int, per time.Duration) *tokenBucket {
+	return &tokenBucket{
+		group:    group,
+		rate:     float64(requests) / per.Seconds(),
+		capacity: float64(requests),
+		tokens:   float64(requests),
+		last:     time.Now(),
+		now:      time.Now,
+		sleep:    time.Sleep,
+	}
+}
+
+// wait blocks until a request fits the budget and returns how long it
+// waited. A nil bucket never waits.
+func (b *tokenBucket) wait() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	// Take a token now, waiting for it to be added if we run short,
+	// so concurrent callers queue up in order
+	b.mu.Lock()
+	now := b.now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay > 0 {
+		logit.Debug("Waiting ", delay, " for the Sheets API ", b.group, " quota")
+		b.sleep(delay)
+	}
+	SheetsRateLimitWaitSeconds.WithLabelValues(b.group).Add(delay.Seconds())
+	return delay
+}
+
+// sheetsLimiter holds the request budgets of the read and write quota
+// groups, a nil bucket is not limited
+type sheetsLimiter struct {
+	read  *tokenBucket
+	write *tokenBucket
+}
+
+// newSheetsLimiter creates the limiter from the rate-limit-* config fields
+func newSheetsLimiter(cfg *Config) (*sheetsLimiter, error) {
+	read, err := parseRateLimit("read", cfg.RateLimitRead)
+	if err != nil {
+		return nil, err
+	}
+	write, err := parseRateLimit("write", cfg.RateLimitWrite)
+	if err != nil {
+		return nil, err
+	}
+	return &sheetsLimiter{read: read, write: write}, nil
+}
+
+// parseRateLimit returns a bucket for a number of requests per quota
+// period, or nil when not set
+func parseRateLimit(group, requests string) (*tokenBucket, error) {
+	if requests == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("rate-limit-%s %q is not a positive number of requests", group, requests)
+	}
+	return newTokenBucket(group, n, quotaPeriod), nil
+}
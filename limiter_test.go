@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2020, 2, 13, 12, 0, 0, 0, time.UTC)
+	var slept time.Duration
+	b := newTokenBucket("write", 10, 100*time.Second)
+	b.last = now
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) { slept += d }
+
+	// The full budget is available at once
+	for i := 0; i < 10; i++ {
+		if d := b.wait(); d != 0 {
+			t.Fatalf("request %d waited %v", i+1, d)
+		}
+	}
+
+	// Then a token is added every 10 seconds, and waiting callers queue up
+	if d := b.wait(); d != 10*time.Second {
+		t.Errorf("11th request waited %v, want 10s", d)
+	}
+	if d := b.wait(); d != 20*time.Second {
+		t.Errorf("12th request waited %v, want 20s", d)
+	}
+	if slept != 30*time.Second {
+		t.Errorf("slept %v, want 30s", slept)
+	}
+
+	// Time passing refills the bucket, but never above the budget
+	now = now.Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		if d := b.wait(); d != 0 {
+			t.Fatalf("request %d after an hour waited %v", i+1, d)
+		}
+	}
+	if d := b.wait(); d != 10*time.Second {
+		t.Errorf("request beyond the budget waited %v, want 10s", d)
+	}
+
+	// No limit
+	var unlimited *tokenBucket
+	if d := unlimited.wait(); d != 0 {
+		t.Errorf("nil bucket waited %v", d)
+	}
+}
+
+func TestNewSheetsLimiter(t *testing.T) {
+	cfg := kpiTestConfig()
+	cfg.RateLimitWrite = "60"
+	limiter, err := newSheetsLimiter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.read != nil || limiter.write == nil || limiter.write.capacity != 60 {
+		t.Errorf("got read %v, write %v", limiter.read, limiter.write)
+	}
+
+	cfg.RateLimitRead = "0"
+	if _, err := newSheetsLimiter(cfg); err == nil {
+		t.Error("expected an error for a zero budget")
+	}
+}
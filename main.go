@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
-	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/takuoki/clmconv"
 	"github.com/tidwall/gjson"
@@ -38,6 +42,25 @@ type Config struct {
 	ChecksPathMetrics  string `yaml:"checks-path-metrics"`
 	ChecksPathReady    string `yaml:"checks-path-ready"`
 	ChecksPathLive     string `yaml:"checks-path-live"`
+	ChecksPathHealth   string `yaml:"checks-path-health"`
+	HealthMaxStaleness string `yaml:"health-max-staleness"` // I.e "192h", fail health when no sync succeeded for this long
+	Schedule           string `yaml:"schedule"`             // Cron expression, run as a daemon when set
+	DryRun             string `yaml:"dry-run"`              // "yes" to only print the planned sheet changes
+	PlanFormat         string `yaml:"plan-format"`          // Format of the dry run plan, "text" or "json"
+	RetryMaxAttempts   string `yaml:"retry-max-attempts"`   // Sheets API call attempts, default 6
+	RetryBaseDelay     string `yaml:"retry-base-delay"`     // Delay before the first retry, default "1s"
+	RetryMaxDelay      string `yaml:"retry-max-delay"`      // Cap on the doubling retry delay, default "64s"
+	RetryJitter        string `yaml:"retry-jitter"`         // Fraction of the delay to randomize, default "0.5"
+	RateLimitRead      string `yaml:"rate-limit-read"`      // Max read requests per 100 seconds, unlimited if unset
+	RateLimitWrite     string `yaml:"rate-limit-write"`     // Max write requests per 100 seconds, unlimited if unset
+	Period             string `yaml:"period"`               // "day", "week" (default), "month", "quarter" or "year"
+	PeriodFormat       string `yaml:"period-format"`        // Topic of a period, i.e "2006-Q{quarter}", see period.go
+	TimeZone           string `yaml:"time-zone"`            // I.e "Europe/Oslo", periods default to UTC
+	AddPeriodColumn    string `yaml:"add-period-column"`    // "append" or "insert" a missing period column
+	AddKPIRows         string `yaml:"add-kpi-rows"`         // "append" or "insert" missing KPI rows
+	PrometheusURL      string `yaml:"prometheus-url"`       // Default server for prometheus sources
+
+	KeyNormalize *KeyNormalization `yaml:"key-normalize"` // How keys are compared, see keys.go
 
 	Datapoints []Datapoint `yaml:"datapoints"`
 	KPI        []KPIs      `yaml:"KPI"` // Legacy actually, will be replaced over time
@@ -45,29 +68,50 @@ type Config struct {
 
 // The KPIs struct holds the array of KPIs
 type KPIs struct {
-	Title          string `yaml:"title"`
-	SheetRow       string `yaml:"sheet-row"`
-	KPICommand     string `yaml:"kpi-command"`
-	KPICommandArgs string `yaml:"kpi-command-args"`
-	JSONEndpoint   string `yaml:"json-endpoint"`
-	JSONDataPicker string `yaml:"json-data-picker"`
+	Title          string           `yaml:"title"`
+	SheetRow       string           `yaml:"sheet-row"` // Found by title in sheet-key-col if unset
+	KPICommand     string           `yaml:"kpi-command"`
+	KPICommandArgs string           `yaml:"kpi-command-args"`
+	JSONEndpoint   string           `yaml:"json-endpoint"`
+	JSONDataPicker string           `yaml:"json-data-picker"`
+	JSONRequest    *HTTPRequest     `yaml:"json-request"` // Method, headers, auth and TLS of json-endpoint
+	Prometheus     *PrometheusQuery `yaml:"prometheus"`
+	SQL            *SQLQuery        `yaml:"sql"`
+	Expression     string           `yaml:"expression"` // Computed from other KPIs, see expression.go
+	Schedule       string           `yaml:"schedule"`   // Override the default schedule
+	ValueType      string           `yaml:"value-type"` // "int", "float" or "decimal", detected if unset
+	Precision      string           `yaml:"precision"`  // Decimals to round the value to
+	Rounding       string           `yaml:"rounding"`   // "half-up" (default), "half-even", "down" or "up"
 }
 
 // The Datapoint struct holds the array of KPIs
 // Specifying add-rows works best when prepolulating some extra rows with required cell functions
 // with relevant cell functions etc copied in.
 type Datapoint struct {
-	Title     string `yaml:"title"`
-	Command   string `yaml:"command"`
-	Args      string `yaml:"args"`
-	AddRows   string `yaml:"add-rows"`   // Specify this if you want to add non-existing rows
-	SheetName string `yaml:"sheet-name"` // Override the default sheet name if you need to
-
-	KeyCol   string `yaml:"key-col"`   // Alternate key column for this data type
-	MatchAll string `yaml:"match-all"` // Alternate keys are often not unique keys
+	Title        string            `yaml:"title"`
+	Command      string            `yaml:"command"`
+	Args         string            `yaml:"args"`
+	Prometheus   *PrometheusQuery  `yaml:"prometheus"`    // Instead of a command, keyed by label values
+	SQL          *SQLQuery         `yaml:"sql"`           // Instead of a command, keyed by the first column
+	Columns      map[string]string `yaml:"columns"`       // Field to topic column, instead of "val" to the title column
+	Format       string            `yaml:"format"`        // Command output: "jsonl" (default), "json", "csv" or "tsv"
+	KeyField     string            `yaml:"key-field"`     // Field of the command output with the keys, default "key"
+	ValueField   string            `yaml:"value-field"`   // Field of the command output with the values, default "val"
+	AddRows      string            `yaml:"add-rows"`      // Specify this if you want to add non-existing rows
+	StalePolicy  string            `yaml:"stale-policy"`  // Rows of keys missing from the scrape: "keep" (default), "clear", "mark", "delete" or "archive"
+	StaleMarker  string            `yaml:"stale-marker"`  // The text stale-policy "mark" sets, default "stale"
+	ArchiveSheet string            `yaml:"archive-sheet"` // The sheet stale-policy "archive" moves rows to
+	SheetName    string            `yaml:"sheet-name"`    // Override the default sheet name if you need to
+
+	KeyCol    string   `yaml:"key-col"`    // Alternate key column for this data type
+	KeyCols   []string `yaml:"key-cols"`   // Columns of a composite key, instead of key-col
+	KeyFields []string `yaml:"key-fields"` // Fields of the output matching key-cols
+	MatchAll  string   `yaml:"match-all"`  // Alternate keys are often not unique keys
 
 	Cell  string `yaml:"cell"`  // Optinal specification of a single cell
 	Value string `yaml:"value"` // combined with a single value to f.i set an "Updating" message
+
+	Schedule string `yaml:"schedule"` // Override the default schedule
 }
 
 // Stores the horizontal and vertical mapping, i.e:
@@ -78,14 +122,28 @@ var keyCache map[string]int
 var keyCacheArr map[string][]int
 var keyCacheMax int
 
-// parseConfigYaml reads CONFIG_FILE or config.yaml,
+// syncMutex serializes sync runs, which share the caches above
+var syncMutex sync.Mutex
+
+// syncTarget is the period a sync writes to
+type syncTarget struct {
+	At       time.Time // Any time within the target period
+	Backfill bool      // Keep existing values and the last updated date
+}
+
+// errNoDataSource is returned when a KPI has no command or endpoint to scrape
+var errNoDataSource = errors.New("no way to gather data")
+
+// parseConfigYaml reads configYaml, CONFIG_FILE or config.yaml,
 // access config ie: cfg.SpreadsheetID and cfg.KPI[0].Title
-func parseConfigYaml(configYamlDefault string) *Config {
+func parseConfigYaml(configYaml string) *Config {
 
 	// Override the location and name of the config.yaml with CONFIG_FILE
-	configYaml := configYamlDefault
-	if os.Getenv("CONFIG_FILE") != "" {
-		configYaml = os.Getenv("CONFIG_FILE")
+	if configYaml == "" {
+		configYaml = configYamlDefault
+		if os.Getenv("CONFIG_FILE") != "" {
+			configYaml = os.Getenv("CONFIG_FILE")
+		}
 	}
 
 	f, err := os.Open(configYaml)
@@ -110,12 +168,16 @@ func parseConfigYaml(configYamlDefault string) *Config {
 	return &cfg
 }
 
-func connectToGoogleSheet(clientSecretFileDefault string, cfg Config) *sheets.Service {
+// connectToGoogleSheet authenticates with clientSecretFile, SECRET_FILE
+// or secret.json
+func connectToGoogleSheet(clientSecretFile string, cfg Config) *sheets.Service {
 
 	// Override the location and name of the secret.json with SECRET_FILE
-	clientSecretFile := clientSecretFileDefault
-	if os.Getenv("SECRET_FILE") != "" {
-		clientSecretFile = os.Getenv("SECRET_FILE")
+	if clientSecretFile == "" {
+		clientSecretFile = clientSecretFileDefault
+		if os.Getenv("SECRET_FILE") != "" {
+			clientSecretFile = os.Getenv("SECRET_FILE")
+		}
 	}
 
 	data, err := ioutil.ReadFile(clientSecretFile)
@@ -148,66 +210,69 @@ func connectToGoogleSheet(clientSecretFileDefault string, cfg Config) *sheets.Se
 }
 
 func main() {
+	os.Exit(runCommand(os.Args[1:]))
+}
 
-	logit.Info("Starting up")
-
-	cfg := parseConfigYaml(configYamlDefault)
-	// Echo main config parameters
-	logit.WithFields(log.Fields{
-		"spreadsheet-id":        cfg.SpreadsheetID,
-		"sheet-name":            cfg.SheetName,
-		"sheet-last-update-col": cfg.SheetLastUpdateCol,
-		"sheet-key-col":         cfg.SheetKeyCol,
-		"sheet-topic-row":       cfg.SheetTopicRow,
-		"sheet-data-start-row":  cfg.SheetDataStartRow,
-		"ckecks-port":           cfg.CkecksPort,
-		"checks-path-metrics":   cfg.ChecksPathMetrics,
-		"checks-path-ready":     cfg.ChecksPathReady,
-		"checks-path-live":      cfg.ChecksPathLive,
-	}).Debug("Spreadsheet")
-
-	// go Serve(":8080", "/_/metrics", "/_/ready", "/_/alive", logit)
-	go Serve(cfg.CkecksPort, cfg.ChecksPathMetrics, cfg.ChecksPathReady,
-		cfg.ChecksPathLive, logit)
-
-	srv := connectToGoogleSheet(clientSecretFileDefault, *cfg)
+// runSync updates the spreadsheet from the KPIs, or the datapoints if
+// there are no KPIs. Only one sync runs at a time as they share caches.
+func runSync(cfg *Config, sink Sink, target syncTarget) *runSummary {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+
+	timer := prometheus.NewTimer(SyncRunDurationSeconds)
+	defer timer.ObserveDuration()
+	health.runStarted()
+
+	// Retry a failed startup ping, as the KPIs of the run can fail for
+	// other reasons than the spreadsheet
+	if !health.isConnected() {
+		if err := sink.Ping(); err == nil {
+			health.setConnected()
+		}
+	}
 
+	var summary *runSummary
 	if cfg.KPI != nil {
 		logit.Debug("Taking the KPI branch!") // Legacy
-		updateGoogleSheetKPI(cfg, srv)
+		summary = updateGoogleSheetKPI(cfg, sink, target)
 	} else {
 		logit.Debug("Taking the datapoints branch!")
-		updateGoogleSheetValues(cfg, srv)
+		summary = updateGoogleSheetValues(cfg, sink)
 	}
+	summary.log()
+	health.runFinished(summary)
 
-	logit.Info("Shutting down")
+	if cfg.DryRun == "yes" {
+		if err := summary.Plan.print(os.Stdout, cfg.PlanFormat); err != nil {
+			logit.WithFields(log.Fields{
+				"error": err,
+			}).Error("Printing plan")
+		}
+		if cfg.PlanFormat != "json" {
+			summary.printNearMisses(os.Stdout)
+		}
+	}
+
+	return summary
 }
 
 // cellValueToSheetLetter reads a sheet row and caches the Column
 // letter for each cell value for conveniant lookup later on.
-func cellValueToSheetLetter(cfg *Config, srv *sheets.Service,
-	searchFor string, cache bool) string {
+func cellValueToSheetLetter(cfg *Config, sink Sink,
+	searchFor string, cache bool) (string, error) {
 
 	rowToSearch := cfg.SheetName + "!" + "A" +
 		cfg.SheetTopicRow + ":" + cfg.SheetTopicRow
-	resp, err := srv.Spreadsheets.Values.Get(cfg.SpreadsheetID, rowToSearch).Do()
-	//resp, err := srv.Spreadsheets.Values.Get(cfg.SpreadsheetID, rowToSearch).ValueRenderOption("UNFORMATTED_VALUE").Do()
+	topics, err := sink.LookupTopic(cfg.SheetName, cfg.SheetTopicRow)
 	if err != nil {
-		logit.WithFields(log.Fields{
-			"cell":        rowToSearch,
-			"error":       err,
-			"spreadsheet": cfg.SpreadsheetID,
-		}).Fatal("Read col data from sheet")
+		return "", fmt.Errorf("read topic row %s: %w", rowToSearch, err)
 	}
 
 	offset := -1 // The offset for this topic
-	if len(resp.Values) == 0 {
-		logit.WithFields(log.Fields{
-			"cell":        rowToSearch,
-			"spreadsheet": cfg.SpreadsheetID,
-		}).Fatal("Topic not found in sheet")
+	if len(topics) == 0 {
+		return "", fmt.Errorf("no topics found in %s", rowToSearch)
 	} else {
-		for colCounter, topic := range resp.Values[0] {
+		for colCounter, topic := range topics {
 
 			if cache {
 				if _, ok := topicCache[fmt.Sprintf("%v", topic)]; !ok {
@@ -229,52 +294,49 @@ func cellValueToSheetLetter(cfg *Config, srv *sheets.Service,
 		}
 	}
 	if offset == -1 && !cache {
-		logit.WithFields(log.Fields{
-			"cell":        rowToSearch,
-			"spreadsheet": cfg.SpreadsheetID,
-		}).Fatal("FIX: Add a new column for topic")
+		return "", fmt.Errorf("FIX: Add a new column for topic %q in %s", searchFor, rowToSearch)
 	}
 
 	//return clmconv.Itoa(dataStartColNum + offset)
-	return clmconv.Itoa(offset)
+	return clmconv.Itoa(offset), nil
 }
 
 // cellValueToSheetRow reads a sheet column and caches the Row
 // number for each cell value for conveniant lookup later on.
-func cellValueToSheetRow(SpreadsheetID string, SheetName string,
-	SheetDataStartRow string, SheetKeyCol string, MatchAll string,
-	srv *sheets.Service, searchFor string, cache bool) int {
-
-	if cache {
-		keyCacheMax = len(keyCache)
-	}
+func cellValueToSheetRow(SheetName string, SheetDataStartRow string, SheetKeyCols []string, MatchAll string,
+	normalizer *keyNormalizer, sink Sink, searchFor string, cache bool) (int, error) {
 
 	sheetDataStartRow, _ := strconv.Atoi(SheetDataStartRow)
-	colToSearch := SheetName + "!" + SheetKeyCol +
-		fmt.Sprintf("%d", sheetDataStartRow) + ":" + SheetKeyCol
 
-	resp, err := srv.Spreadsheets.Values.Get(SpreadsheetID, colToSearch).Do()
-	//resp, err := srv.Spreadsheets.Values.Get(SpreadsheetID, colToSearch).ValueRenderOption("UNFORMATTED_VALUE").Do()
+	// Keys added by earlier datapoints are not in the sheet yet
+	if cache {
+		keyCacheMax = 0
+		for _, row := range keyCache {
+			if keyCacheMax < row-sheetDataStartRow {
+				keyCacheMax = row - sheetDataStartRow
+			}
+		}
+	}
+	var colsToSearch []string
+	for _, col := range SheetKeyCols {
+		colsToSearch = append(colsToSearch, SheetName+"!"+col+
+			fmt.Sprintf("%d", sheetDataStartRow)+":"+col)
+	}
+	colToSearch := strings.Join(colsToSearch, ", ")
 
+	keys, err := lookupKeys(sink, SheetName, SheetKeyCols, sheetDataStartRow, normalizer)
 	if err != nil {
-		logit.WithFields(log.Fields{
-			"cell":        colToSearch,
-			"error":       err,
-			"spreadsheet": SpreadsheetID,
-		}).Fatal("Read row data from sheet")
+		return -1, fmt.Errorf("read key column %s: %w", colToSearch, err)
 	}
 
 	logit.Debug("colToSearch: ", colToSearch)
 
 	offset := -1 // The offset for this row
-	if len(resp.Values) == 0 {
-		logit.WithFields(log.Fields{
-			"col":         colToSearch,
-			"spreadsheet": SpreadsheetID,
-		}).Fatal("No data found in col")
+	if len(keys) == 0 {
+		return -1, fmt.Errorf("no keys found in %s", colToSearch)
 	} else {
 
-		for rowCounter, row := range resp.Values {
+		for rowCounter, row := range keys {
 
 			if cache && len(row) > 0 {
 				if _, ok := keyCache[fmt.Sprintf("%v", row[0])]; !ok {
@@ -294,7 +356,7 @@ func cellValueToSheetRow(SpreadsheetID string, SheetName string,
 				}
 			}
 
-			if len(row) > 0 && searchFor == row[0] && offset == -1 {
+			if len(row) > 0 && normalizer.normalize(searchFor) == row[0] && offset == -1 {
 				offset = rowCounter
 				if !cache {
 					break // Break quickly if not a caching run
@@ -303,89 +365,193 @@ func cellValueToSheetRow(SpreadsheetID string, SheetName string,
 		}
 	}
 	if offset == -1 && !cache {
-		logit.WithFields(log.Fields{
-			"cell":        colToSearch,
-			"spreadsheet": SpreadsheetID,
-		}).Fatal("FIX: Add a new row for key")
+		return -1, fmt.Errorf("FIX: Add a new row for key %q in %s", searchFor, colToSearch)
 	}
 
-	return sheetDataStartRow + offset
+	return sheetDataStartRow + offset, nil
 }
 
-// updateGoogleSheetValues updates the Google Spreadsheet
-func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
-
-	// Generic value holder
-	var vr sheets.ValueRange
-	vr.Values = make([][]interface{}, 1)
+// updateGoogleSheetValues updates the Google Spreadsheet, a datapoint
+// failing does not stop the remaining datapoints from being updated.
+func updateGoogleSheetValues(cfg *Config, sink Sink) *runSummary {
 
+	summary := newRunSummary()
 	sheetDataStartRow, _ := strconv.Atoi(cfg.SheetDataStartRow)
+	periods, err := newPeriodFormat(cfg)
+	if err != nil {
+		summary.abort(err)
+		return summary
+	}
+	window := periods.window(time.Now(), time.Now())
+	normalizer, err := newKeyNormalizer(cfg)
+	if err != nil {
+		summary.abort(err)
+		return summary
+	}
 
-	// Prepare to cache values
+	// Prepare to cache values, the keys per set of key columns
 	topicCache = make(map[string]string)
-	keyCache = make(map[string]int)
-	keyCacheArr = make(map[string][]int)
+	type rowCache struct {
+		rows map[string]int
+		all  map[string][]int
+	}
+	keyCaches := make(map[string]rowCache)
+
+	// Read the topic row once, and all the columns to update in one go
+	if _, err := cellValueToSheetLetter(cfg, sink, "", true); err != nil {
+		summary.abort(err)
+		return summary
+	}
+	var colRanges []string
+	for _, dp := range cfg.Datapoints {
+		if !dp.hasSource() {
+			continue
+		}
+		for _, column := range dp.columns() {
+			if _, ok := topicCache[column.Topic]; ok {
+				colRanges = append(colRanges, cfg.SheetName+"!"+topicCache[column.Topic]+
+					cfg.SheetDataStartRow+":"+topicCache[column.Topic])
+			}
+		}
+	}
+	colValues, err := readRanges(sink, colRanges, true)
+	if err != nil {
+		summary.abort(fmt.Errorf("read columns (is sheet-topic-row set correctly?): %w", err))
+		return summary
+	}
+	columns := make(map[string][][]interface{})
+	for i, col := range colRanges {
+		columns[col] = colValues[i]
+	}
+
+	// Columns are written together after the loop, the cell counts
+	// are kept for the upload metrics until then
+	batch := &writeBatch{}
+
+	// Rows of the keys in the scrapes, and of stale keys to remove after the writes
+	seenRows := make(map[int]bool)
+	var removeRows []staleRow
+	type cellCount struct{ updated, unplaced int }
+	cellCounts := make(map[string]cellCount)
 
 	// Update for all data types in the configuration
 	for _, dp := range cfg.Datapoints {
 
-		// Support for per data point override of key column.
-		keyCol := cfg.SheetKeyCol
-		if dp.KeyCol != "" {
-			keyCol = dp.KeyCol
+		// Support for per data point override of key column,
+		// or columns of a composite key
+		keyCols := dp.keyCols(cfg)
+		cacheID := strings.Join(keyCols, ",")
+		cache, ok := keyCaches[cacheID]
+		if !ok {
+			cache = rowCache{make(map[string]int), make(map[string][]int)}
+			keyCaches[cacheID] = cache
 		}
+		keyCache, keyCacheArr = cache.rows, cache.all
 
 		// Calculate the Column letter and Row number for a cell value
-		_ = cellValueToSheetLetter(cfg, srv, dp.Title, true)
-		_ = cellValueToSheetRow(cfg.SpreadsheetID, cfg.SheetName, cfg.SheetDataStartRow, keyCol, dp.MatchAll, srv, "", true)
+		dpColumns := dp.columns()
+		var missing error
+		for _, column := range dpColumns {
+			if _, ok := topicCache[column.Topic]; !ok {
+				missing = fmt.Errorf("FIX: Add a new column for topic %q in %s", column.Topic,
+					cfg.SheetName+"!"+"A"+cfg.SheetTopicRow+":"+cfg.SheetTopicRow)
+				break
+			}
+		}
+		if missing != nil {
+			summary.failed(dp.Title, missing)
+			continue
+		}
+		if _, err := cellValueToSheetRow(cfg.SheetName, cfg.SheetDataStartRow, keyCols, dp.MatchAll, normalizer, sink, "", true); err != nil {
+			summary.failed(dp.Title, err)
+			continue
+		}
 
-		logit.WithFields(log.Fields{
-			"title":       dp.Title,
-			"col":         topicCache[dp.Title],
-			"spreadsheet": cfg.SpreadsheetID,
-			"command":     dp.Command + " " + dp.Args,
-		}).Debug("Sheet and command info")
+		// Run the command, or query the data source, once for all its columns
+		var records []datapointRecord
+		if dp.hasSource() {
+			out, err := scrapeDatapoint(cfg, &dp, window)
+			if err == nil {
+				records, err = parseDatapointOutput(&dp, out, normalizer)
+			}
+			if err != nil {
+				KPIScrapeErrors.WithLabelValues(dp.Title).Inc()
+				summary.failed(dp.Title, err)
+				continue
+			}
+			ReadEndpointData.Inc()
+		}
+		matchedRows := make(map[int]bool) // Rows of the keys in this scrape
+		for _, record := range records {
+			if row, ok := keyCache[record.Key]; ok {
+				matchedRows[row] = true
+			}
+			for _, row := range keyCacheArr[record.Key] {
+				matchedRows[row] = true
+			}
+		}
+		for row := range matchedRows {
+			seenRows[row] = true
+		}
+		staleRows := findStaleRows(&dp, keyCols[0], records, matchedRows)
+		staleValue, setStale := dp.staleValue()
+		if !setStale {
+			removeRows = append(removeRows, staleRows...)
+		}
 
-		var sheetValues [][]interface{}
-		col := cfg.SheetName + "!" + topicCache[dp.Title] + cfg.SheetDataStartRow + ":" + topicCache[dp.Title]
+		updated, unplaced := 0, 0 // Cell counts for upload metrics
+		unplacedKeys := make(map[string]bool)
+		addedRows := make(map[string]int) // Rows added for new keys, shared by the columns
+
+		// If the column being updated is the keys column,
+		// we have to add a new value to the keyCache
+		addKey := func(column datapointColumn, val string, scrapeNum int) {
+			if len(keyCols) == 1 && topicCache[column.Topic] == cfg.SheetKeyCol {
+				key := normalizer.normalize(val)
+				keyCache[key] = sheetDataStartRow + scrapeNum
+				if dp.MatchAll == "yes" {
+					keyCacheArr[key] = append(keyCacheArr[key], sheetDataStartRow+scrapeNum)
+				}
+			}
+		}
+		for _, column := range dpColumns {
+
+			logit.WithFields(log.Fields{
+				"title":       dp.Title,
+				"col":         topicCache[column.Topic],
+				"field":       column.Field,
+				"spreadsheet": cfg.SpreadsheetID,
+				"command":     dp.Command + " " + dp.Args,
+			}).Debug("Sheet and command info")
 
-		// Run the command
-		if len(dp.Command) > 0 {
+			var sheetValues [][]interface{}
+			col := cfg.SheetName + "!" + topicCache[column.Topic] + cfg.SheetDataStartRow + ":" + topicCache[column.Topic]
 
-			// Run KPI colleting command
-			cmd := exec.Command(dp.Command, dp.Args)
-			tmpOut, err := cmd.CombinedOutput()
-			if err != nil {
-				logit.WithFields(log.Fields{
-					"kpi":     dp.Title,
-					"error":   err,
-					"command": dp.Command + " " + dp.Args,
-				}).Fatal("Running external command")
+			// Record the change of a cell in a dry run
+			planCell := func(scrapeNum int, val string) {
+				if cfg.DryRun == "yes" {
+					summary.Plan.add(column.Topic, cfg.SheetName+"!"+topicCache[column.Topic]+
+						strconv.Itoa(sheetDataStartRow+scrapeNum), sheetValues[scrapeNum][0], val)
+				}
 			}
 
-			// resp contains an interface of all values in the column
-			resp, err := srv.Spreadsheets.Values.Get(cfg.SpreadsheetID, col).ValueRenderOption("UNFORMATTED_VALUE").Do()
-
-			if err != nil {
-				logit.WithFields(log.Fields{
-					"col":         col,
-					"error":       err,
-					"hint":        "is sheet-topic-row set correctly?",
-					"spreadsheet": cfg.SpreadsheetID,
-				}).Fatal("Read column data from sheet")
+			if !dp.hasSource() {
+				continue
 			}
-			sheetValues = resp.Values
+
+			// sheetValues contains an interface of all values in the column
+			sheetValues = columns[col]
 
 			// If some of the last cells in the data row
 			// has not values, the sheetValues array will be
 			// too short and we need to extend it to hold
 			// all the values we get.
 			sheetValuesLen := len(sheetValues)
-			if sheetValuesLen < keyCacheMax {
+			if sheetValuesLen <= keyCacheMax {
 				logit.WithFields(log.Fields{
 					"rows":        keyCacheMax + 1,
 					"spreadsheet": cfg.SpreadsheetID,
-					"col":         topicCache[dp.Title],
+					"col":         topicCache[column.Topic],
 				}).Debug("Extending Sheetvalues")
 				newSlice := make([][]interface{}, sheetValuesLen, keyCacheMax+1)
 				copy(newSlice, sheetValues)
@@ -398,17 +564,17 @@ func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
 				}
 			}
 
-			// Lets use github.com/tidwall/gjson to decode
-			// JSON lines
-			json := string(tmpOut)
-
 			// Loop all results from the external command
 			// and compare to the values from the sheet
-			gjson.ForEachLine(json, func(line gjson.Result) bool {
-
-				// Get the key value pair from the scraping command
-				key := gjson.Get(line.String(), "key").String()
-				val := gjson.Get(line.String(), "val").String()
+			for _, record := range records {
+
+				// Get the key value pair from the scraping command,
+				// records without a value for this column are skipped
+				key := record.Key
+				val, ok := record.field(column.Field)
+				if !ok && column.Field != dp.valueField() {
+					continue
+				}
 
 				// Update sheet
 				if sheetRowNum, ok := keyCache[key]; ok {
@@ -420,24 +586,26 @@ func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
 						sheetValues[scrapeNum] = []interface{}{""}
 					}
 
-					if val != fmt.Sprintf("%v", sheetValues[scrapeNum][0]) {
+					if !sameValue(sheetValues[scrapeNum][0], val) {
 
 						logit.WithFields(log.Fields{
 							"row":         scrapeNum,
 							"spreadsheet": cfg.SpreadsheetID,
-							"col":         topicCache[dp.Title],
+							"col":         topicCache[column.Topic],
 							"key":         key,
 							"val":         val,
 							"old-val":     sheetValues[scrapeNum][0],
 						}).Debug("Updating value")
 
+						planCell(scrapeNum, val)
 						sheetValues[scrapeNum][0] = val
+						updated++
 
 					} else {
 						logit.WithFields(log.Fields{
 							"row":         scrapeNum,
 							"spreadsheet": cfg.SpreadsheetID,
-							"col":         topicCache[dp.Title],
+							"col":         topicCache[column.Topic],
 							"key":         key,
 							"val":         val,
 							"old-val":     sheetValues[scrapeNum][0],
@@ -461,24 +629,26 @@ func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
 								sheetValues[scrapeNum] = []interface{}{""}
 							}
 
-							if val != fmt.Sprintf("%v", sheetValues[scrapeNum][0]) {
+							if !sameValue(sheetValues[scrapeNum][0], val) {
 
 								logit.WithFields(log.Fields{
 									"row":         scrapeNum,
 									"spreadsheet": cfg.SpreadsheetID,
-									"col":         topicCache[dp.Title],
+									"col":         topicCache[column.Topic],
 									"key":         key,
 									"val":         val,
 									"old-val":     sheetValues[scrapeNum][0],
 								}).Debug("Updating value")
 
+								planCell(scrapeNum, val)
 								sheetValues[scrapeNum][0] = val
+								updated++
 
 							} else {
 								logit.WithFields(log.Fields{
 									"row":         scrapeNum,
 									"spreadsheet": cfg.SpreadsheetID,
-									"col":         topicCache[dp.Title],
+									"col":         topicCache[column.Topic],
 									"key":         key,
 									"val":         val,
 									"old-val":     sheetValues[scrapeNum][0],
@@ -492,32 +662,45 @@ func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
 				} else {
 
 					if dp.AddRows == "yes" {
+
+						// A row already added by another column of the
+						// datapoint gets the value in the same row
+						if scrapeNum, ok := addedRows[key]; ok {
+							for len(sheetValues) <= scrapeNum {
+								sheetValues = append(sheetValues, []interface{}{""})
+							}
+							planCell(scrapeNum, val)
+							sheetValues[scrapeNum] = []interface{}{val}
+							addKey(column, val, scrapeNum)
+							updated++
+							continue
+						}
+
 						logit.WithFields(log.Fields{
 							"spreadsheet": cfg.SpreadsheetID,
-							"col":         topicCache[dp.Title],
+							"col":         topicCache[column.Topic],
 							"key":         key,
 							"val":         val,
 						}).Debug("Appending column")
 						sheetValues = append(sheetValues, []interface{}{val})
 						sheetValues = sheetValues[0:len(sheetValues)]
 						keyCacheMax = len(sheetValues) - 1
-
-						// If the column being updated is the keys column,
-						// we have to add a new value to the keyCache
-						if topicCache[dp.Title] == cfg.SheetKeyCol {
-							keyCache[fmt.Sprintf("%v", val)] = sheetDataStartRow + keyCacheMax
-							if dp.MatchAll == "yes" {
-								keyCacheArr[fmt.Sprintf("%v", val)] = append(keyCacheArr[fmt.Sprintf("%v", val)], sheetDataStartRow+keyCacheMax)
-							}
-						}
+						addedRows[key] = keyCacheMax
+						matchedRows[sheetDataStartRow+keyCacheMax] = true
+						addKey(column, val, keyCacheMax)
 
 						logit.WithFields(log.Fields{
 							"row":         len(sheetValues),
 							"spreadsheet": cfg.SpreadsheetID,
-							"col":         topicCache[dp.Title],
+							"col":         topicCache[column.Topic],
 							"key":         key,
 							"val":         val,
 						}).Debug("Adding new row")
+						updated++
+						if cfg.DryRun == "yes" {
+							summary.Plan.add(column.Topic, cfg.SheetName+"!"+topicCache[column.Topic]+
+								strconv.Itoa(sheetDataStartRow+keyCacheMax), "", val)
+						}
 
 					} else {
 
@@ -525,241 +708,454 @@ func updateGoogleSheetValues(cfg *Config, srv *sheets.Service) {
 							"kpi": dp.Title,
 							"key": key,
 						}).Warning("Can not update column")
+						unplaced++
+						unplacedKeys[key] = true
 					}
 
 				}
+			}
 
-				return true
-			})
+			// Clear or mark the cells of stale keys, but not the keys
+			for _, stale := range staleRows {
+				if !setStale || dp.isKeyCol(cfg, topicCache[column.Topic]) {
+					break
+				}
+				if matchedRows[stale.Row] {
+					continue
+				}
+				scrapeNum := stale.Row - sheetDataStartRow
+				for len(sheetValues) <= scrapeNum {
+					sheetValues = append(sheetValues, []interface{}{""})
+				}
+				if len(sheetValues[scrapeNum]) == 0 {
+					sheetValues[scrapeNum] = []interface{}{""}
+				}
+				if !sameValue(sheetValues[scrapeNum][0], staleValue) {
+					logit.WithFields(log.Fields{
+						"row":         scrapeNum,
+						"spreadsheet": cfg.SpreadsheetID,
+						"col":         topicCache[column.Topic],
+						"key":         stale.Key,
+						"val":         staleValue,
+						"old-val":     sheetValues[scrapeNum][0],
+					}).Debug("Updating stale value")
+
+					planCell(scrapeNum, staleValue)
+					sheetValues[scrapeNum][0] = staleValue
+					updated++
+				}
+			}
 
+			// Later datapoints writing the column start from these values
+			columns[col] = sheetValues
+			if cfg.DryRun != "yes" && len(sheetValues) > 0 {
+				batch.add(dp.Title, col, sheetValues)
+			}
 		}
 
-		// Updated values to set in the sheet
-		vr.Values = sheetValues
-
-		// We might hit the "Quota exceeded for quota group 'WriteGroup'"
-		r, _ := regexp.Compile("Error 429|operation timed out")
-		iterations := 12
-		var err error
-		for iterations > 0 {
-			_, err = srv.Spreadsheets.Values.Update(cfg.SpreadsheetID,
-				col, &vr).ValueInputOption("USER_ENTERED").Do()
-			iterations--
-
-			if err != nil && r.MatchString(err.Error()) {
-				logit.Debug("Sleeping 10 sec")
-				time.Sleep(10000 * time.Millisecond)
-			} else {
-				iterations = 0
+		// Report the sheet keys likely meant by the keys not in the sheet
+		if len(unplacedKeys) > 0 {
+			var sheetKeys []string
+			for key := range keyCache {
+				sheetKeys = append(sheetKeys, key)
 			}
-			if err != nil && iterations == 0 {
-
-				// We might want to try again if we simply time out
-				logit.WithFields(log.Fields{
-					"col":         col,
-					"error":       err,
-					"spreadsheet": cfg.SpreadsheetID,
-				}).Fatal("Update sheet column")
+			for _, key := range sortedKeys(unplacedKeys) {
+				if candidates := nearMisses(key, sheetKeys); len(candidates) > 0 {
+					summary.nearMiss(dp.Title, key, candidates)
+				}
 			}
 		}
 
+		if cfg.DryRun == "yes" {
+			summary.synced(dp.Title)
+			continue
+		}
+		cellCounts[dp.Title] = cellCount{updated, unplaced}
 	}
+
+	// Write all the columns, then remove the stale rows below them
+	failed := batch.flush(sink)
+	removeStaleRows(cfg, sink, &summary.Plan, removeRows, seenRows, failed)
+	for _, dp := range cfg.Datapoints {
+		count, ok := cellCounts[dp.Title]
+		if !ok {
+			continue // Already failed or a dry run
+		}
+		delete(cellCounts, dp.Title)
+		if err := failed[dp.Title]; err != nil {
+			summary.failed(dp.Title, err)
+			DataUploadedToSheet.WithLabelValues(syncStatusFailed).Add(float64(count.updated + count.unplaced))
+			continue
+		}
+		summary.synced(dp.Title)
+		KPILastSuccessTimestamp.WithLabelValues(dp.Title).SetToCurrentTime()
+		DataUploadedToSheet.WithLabelValues(syncStatusSynced).Add(float64(count.updated))
+		DataUploadedToSheet.WithLabelValues(syncStatusFailed).Add(float64(count.unplaced))
+	}
+
+	return summary
 }
 
-// updateGoogleSheetKPI updates the Google Spreadsheet
-func updateGoogleSheetKPI(cfg *Config, srv *sheets.Service) {
+// updateGoogleSheetKPI updates the Google Spreadsheet, a KPI failing
+// does not stop the remaining KPIs from being updated.
+func updateGoogleSheetKPI(cfg *Config, sink Sink, target syncTarget) *runSummary {
 
-	// Construct the string matching this week ("YYYY-WW")
-	tn := time.Now().UTC()
-	year, week := tn.ISOWeek()
-	nowYearWeek := fmt.Sprintf("%d-%02d", year, week)
-	lastUpdateDate := time.Now().Format("2006-01-02")
-	logit.WithFields(log.Fields{
-		"date": nowYearWeek,
-	}).Debug("Current week")
+	summary := newRunSummary()
 
-	// Calculate the Column letter for this week
-	dataWeekColLetter := cellValueToSheetLetter(cfg, srv, nowYearWeek, false)
+	// Construct the string matching the target period, i.e "YYYY-WW"
+	periods, err := newPeriodFormat(cfg)
+	if err != nil {
+		summary.abort(err)
+		return summary
+	}
+	window := periods.window(target.At, time.Now())
+	topic := window.Topic
+	lastUpdate := time.Now()
+	if cfg.TimeZone != "" {
+		lastUpdate = lastUpdate.In(periods.location)
+	}
+	lastUpdateDate := lastUpdate.Format("2006-01-02")
+	logit.WithFields(log.Fields{
+		"period": topic,
+	}).Debug("Current period")
+
+	// Calculate the Column letter for this period, adding the
+	// column when missing if configured to
+	periodColLetter, err := cellValueToSheetLetter(cfg, sink, topic, false)
+	newPeriodColumn := false
+	if err != nil && cfg.AddPeriodColumn != "" {
+		periodColLetter, err = addPeriodColumn(cfg, sink, periods, target.At, &summary.Plan)
+		newPeriodColumn = true
+	}
+	if err != nil {
+		summary.abort(err)
+		return summary
+	}
 
-	// Variables for each state for gauge metrics
-	//var valuesSynced, valuesCollision, valuesFailed int
-	syncCount := map[int]int{
-		errorCode["synced"]:    0,
-		errorCode["collision"]: 0,
-		errorCode["failed"]:    0,
+	// Scrape all KPIs before touching the sheet
+	type scrapedKPI struct {
+		kpi   KPIs
+		value interface{}
 	}
+	var scraped []scrapedKPI
+	scrapedValues := make(map[string]interface{}) // By title, for the expressions
+	for _, kpi := range cfg.KPI {
+		if kpi.Expression != "" {
+			continue // Computed below
+		}
 
-	// Generic value holder
-	var vr sheets.ValueRange
-	vr.Values = make([][]interface{}, 1)
+		out, err := scrapeEndpoint(cfg, &kpi, window)
+		if err == errNoDataSource {
+			logit.WithFields(log.Fields{
+				"kpi": kpi.Title,
+			}).Warning("No way to gather data")
+			summary.skipped(kpi.Title)
+			continue
+		} else if err != nil {
+			KPIScrapeErrors.WithLabelValues(kpi.Title).Inc()
+			summary.failed(kpi.Title, err)
+			continue
+		}
+		ReadEndpointData.Inc()
+		KPIValue.WithLabelValues(kpi.Title).Set(valueToFloat(out))
+		scraped = append(scraped, scrapedKPI{kpi: kpi, value: out})
+		scrapedValues[kpi.Title] = out
+	}
 
-	for _, kpi := range cfg.KPI {
+	// Derived KPIs are computed from the values scraped above
+	for _, result := range evaluateExpressions(cfg, sink, periods, target.At, scrapedValues) {
+		if result.err != nil {
+			KPIScrapeErrors.WithLabelValues(result.kpi.Title).Inc()
+			summary.failed(result.kpi.Title, result.err)
+			continue
+		}
+		KPIValue.WithLabelValues(result.kpi.Title).Set(valueToFloat(result.value))
+		scraped = append(scraped, scrapedKPI{kpi: result.kpi, value: result.value})
+	}
 
-		ok, out := scrapeEndpoint(&kpi)
-		if !ok {
+	// Find the row of each KPI, adding missing rows if configured to
+	kpis := make([]KPIs, len(scraped))
+	for i, s := range scraped {
+		kpis[i] = s.kpi
+	}
+	rows := kpiRows(cfg, sink, kpis)
+
+	// The cells to set per KPI
+	type kpiCell struct {
+		action    string
+		cell      string
+		value     interface{}
+		overwrite int
+		isNew     bool // In a column or row a dry run did not add, so still empty
+	}
+	cells := make([][]kpiCell, len(scraped))
+	var reads []string
+	for i, s := range scraped {
+		if rows[i].err != nil {
+			summary.failed(s.kpi.Title, rows[i].err)
 			continue
 		}
+		row := strconv.Itoa(rows[i].row)
+		newRow := rows[i].added && cfg.DryRun == "yes"
 
-		// Write KPI title
 		// We should not overwrite a KPI title, only set it if
-		// it is unset, we should also break off the update if
-		// the KPI title is not matching.
-		syncCount[writeSheetCell(&kpi,
-			"Setting KPI title",
-			[]interface{}{kpi.Title},
-			cfg.SheetName+"!"+
-				cfg.SheetKeyCol+kpi.SheetRow+":"+
-				cfg.SheetKeyCol+kpi.SheetRow,
-			cfg, srv, &vr, 0)]++
-
-		// Write KPI value
-		syncCount[writeSheetCell(&kpi,
-			"Setting KPI value",
-			[]interface{}{out},
-			cfg.SheetName+"!"+
-				dataWeekColLetter+kpi.SheetRow+":"+
-				dataWeekColLetter+kpi.SheetRow,
-			cfg, srv, &vr, 1)]++
-
-		// Update the 'last updated' date
-		syncCount[writeSheetCell(&kpi,
-			"Setting last updated date",
-			[]interface{}{lastUpdateDate},
-			cfg.SheetName+"!"+
-				cfg.SheetLastUpdateCol+kpi.SheetRow+":"+
-				cfg.SheetLastUpdateCol+kpi.SheetRow,
-			cfg, srv, &vr, 1)]++
-	}
-
-	// Set all the gauge metrics at the end to provide a consistent step
-	//DataUploadedToSheet.WithLabelValues(syncStatusSynced).Set(float64(syncCount[errorCode["synced"]]))
-	//DataUploadedToSheet.WithLabelValues(syncStatusFailed).Set(float64(syncCount[errorCode["failed"]]))
-	//DataUploadedToSheet.WithLabelValues(syncStatusCollision).Set(float64(syncCount[errorCode["collision"]]))
+		// it is unset, and a backfill never overwrites existing values
+		valueOverwrite := 1
+		if target.Backfill {
+			valueOverwrite = 0
+		}
+		cells[i] = []kpiCell{
+			{"Setting KPI title", cfg.SheetName + "!" + cfg.SheetKeyCol + row + ":" + cfg.SheetKeyCol + row,
+				s.kpi.Title, 0, newRow},
+			{"Setting KPI value", cfg.SheetName + "!" + periodColLetter + row + ":" + periodColLetter + row,
+				s.value, valueOverwrite, newRow || (newPeriodColumn && cfg.DryRun == "yes")},
+		}
+
+		// The 'last updated' date tracks the current period
+		// and is left alone by a backfill
+		if !target.Backfill {
+			cells[i] = append(cells[i], kpiCell{"Setting last updated date",
+				cfg.SheetName + "!" + cfg.SheetLastUpdateCol + row + ":" + cfg.SheetLastUpdateCol + row,
+				lastUpdateDate, 1, newRow})
+		}
+
+		// Existing values are needed to not overwrite them, and for a dry run
+		for _, c := range cells[i] {
+			if (c.overwrite == 0 || cfg.DryRun == "yes") && !c.isNew {
+				reads = append(reads, c.cell)
+			}
+		}
+	}
+
+	// Read all the existing values at once
+	values, err := readRanges(sink, reads, true)
+	if err != nil {
+		summary.abort(fmt.Errorf("read KPI cells: %w", err))
+		return summary
+	}
+	existing := make(map[string]interface{})
+	for i, cell := range reads {
+		existing[cell] = firstValue(values[i])
+	}
+
+	// Queue all the writes, and write them at once
+	batch := &writeBatch{}
+	collisions := 0
+	queued := make(map[string]int)
+	for i, s := range scraped {
+		for _, c := range cells[i] {
+			code := writeSheetCell(&s.kpi, c.action, []interface{}{c.value},
+				c.cell, existing[c.cell], cfg, batch, &summary.Plan, c.overwrite)
+			if code == errorCode[syncStatusCollision] {
+				collisions++
+			} else {
+				queued[s.kpi.Title]++
+			}
+		}
+	}
+	failed := batch.flush(sink)
 
+	synced, failedCells := 0, 0
+	for i, s := range scraped {
+		if rows[i].err != nil {
+			continue // Already failed
+		}
+		if err := failed[s.kpi.Title]; err != nil {
+			summary.failed(s.kpi.Title, err)
+			failedCells += queued[s.kpi.Title]
+			continue
+		}
+		synced += queued[s.kpi.Title]
+		summary.synced(s.kpi.Title)
+		KPILastSuccessTimestamp.WithLabelValues(s.kpi.Title).SetToCurrentTime()
+	}
+
+	// Count all the uploads at the end to provide a consistent step
+	DataUploadedToSheet.WithLabelValues(syncStatusSynced).Add(float64(synced))
+	DataUploadedToSheet.WithLabelValues(syncStatusFailed).Add(float64(failedCells))
+	DataUploadedToSheet.WithLabelValues(syncStatusCollision).Add(float64(collisions))
+
+	return summary
 }
 
 // scrapeEndpoint connects to an HTTP service and retrieves and matches a JSON encoded value
-// or runs and use the return number from an external command
-func scrapeEndpoint(kpi *KPIs) (bool, int) {
+// or runs and use the return number from an external command, for the value at the end of
+// the period window
+func scrapeEndpoint(cfg *Config, kpi *KPIs, window periodWindow) (interface{}, error) {
 	logit.WithFields(log.Fields{
 		"title":         kpi.Title,
 		"JSON-endpoint": kpi.JSONEndpoint,
+		"period":        window.Topic,
 	}).Debug("Scraping endpoint")
 
-	var out int
-	// Run the Web scrape command (if defined)
-	if len(kpi.JSONEndpoint) > 0 {
+	var out string
+	if kpi.Prometheus != nil {
 
-		out = scrapeToJSON(kpi.JSONEndpoint, kpi.JSONDataPicker)
-		return true, out
+		var err error
+		if out, err = kpi.Prometheus.value(cfg.PrometheusURL, window); err != nil {
+			return nil, err
+		}
+
+	} else if kpi.SQL != nil {
+
+		var err error
+		if out, err = kpi.SQL.value(window); err != nil {
+			return nil, err
+		}
+
+		// Run the Web scrape command (if defined)
+	} else if len(kpi.JSONEndpoint) > 0 {
+
+		var err error
+		uri := window.expand(kpi.JSONEndpoint, url.QueryEscape)
+		if out, err = scrapeToJSON(uri, kpi.JSONDataPicker, kpi.JSONRequest); err != nil {
+			return nil, err
+		}
 
 	} else if len(kpi.KPICommand) > 0 {
 
-		// Run KPI colleting command
-		cmd := exec.Command(kpi.KPICommand, kpi.KPICommandArgs)
+		// Run KPI colleting command, telling it the period
+		args := window.expand(kpi.KPICommandArgs, func(s string) string { return s })
+		cmd := exec.Command(kpi.KPICommand, args)
+		cmd.Env = append(os.Environ(), window.env()...)
 		tmpOut, err := cmd.CombinedOutput()
 		if err != nil {
-			logit.WithFields(log.Fields{
-				"kpi":     kpi.Title,
-				"error":   err,
-				"command": kpi.KPICommand + " " + kpi.KPICommandArgs,
-			}).Fatal("Running external command")
+			return nil, fmt.Errorf("running external command %s %s: %w",
+				kpi.KPICommand, args, err)
 		}
-		_, _ = fmt.Sscanf(string(tmpOut), "%d", &out) // Catch the result number
-		return true, out
+		out = string(tmpOut)
 
 	} else {
+		return nil, errNoDataSource
+	}
 
-		logit.WithFields(log.Fields{
-			"kpi": kpi.Title,
-		}).Warning("No way to gather data")
-		return false, -1
-
+	value, err := parseKPIValue(out, kpi)
+	if err != nil {
+		return nil, fmt.Errorf("parsing the result of %s: %w", kpi.Title, err)
 	}
+	return value, nil
 }
 
-// writeSheetCell takes a number of parameters and updates a sheet cell with a specified value
-func writeSheetCell(kpi *KPIs, action string, value []interface{},
-	cell string, cfg *Config, srv *sheets.Service,
-	vr *sheets.ValueRange, overwrite int) int {
+// hasSource tells if the datapoint has a command or query to get values from
+func (dp *Datapoint) hasSource() bool {
+	return dp.Command != "" || dp.Prometheus != nil || dp.SQL != nil
+}
 
-	// Check if existing vakue is an empty value or if it is the
-	// same value as we want to set.
-	if overwrite == 0 {
-		resp, err := srv.Spreadsheets.Values.Get(cfg.SpreadsheetID, cell).ValueRenderOption("UNFORMATTED_VALUE").Do()
+// datapointColumn is a topic column a datapoint writes, and the field of
+// its JSON lines holding the values
+type datapointColumn struct {
+	Topic string
+	Field string
+}
 
-		if err != nil {
-			logit.WithFields(log.Fields{
-				"cell":        cell,
-				"error":       err,
-				"spreadsheet": cfg.SpreadsheetID,
-			}).Fatal("Read cell data from sheet")
-		}
+// columns returns the topic columns of the datapoint, sorted by field.
+// Without columns, the value field goes to the column of the title.
+func (dp *Datapoint) columns() []datapointColumn {
+	if len(dp.Columns) == 0 {
+		return []datapointColumn{{Topic: dp.Title, Field: dp.valueField()}}
+	}
+	var columns []datapointColumn
+	for field, topic := range dp.Columns {
+		columns = append(columns, datapointColumn{Topic: topic, Field: field})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].Field < columns[j].Field })
+	return columns
+}
 
-		// A value exists but is not the same as we got.
-		if len(resp.Values) > 0 && resp.Values[0][0] != value[0] {
-			logit.WithFields(log.Fields{
-				"cell":        cell,
-				"error":       err,
-				"spreadsheet": cfg.SpreadsheetID,
-				"cellValue":   resp.Values[0][0],
-				"newValue":    value[0],
-			}).Warning("Skip ", action)
+// validateColumns checks the columns of the datapoint
+func (dp *Datapoint) validateColumns() error {
+	if dp.Prometheus != nil {
+		return fmt.Errorf("columns need a command or sql, prometheus gives a single value per key")
+	}
+	topics := make(map[string]string)
+	for _, column := range dp.columns() {
+		switch {
+		case column.Field == "":
+			return fmt.Errorf("column for topic %q has no field", column.Topic)
+		case column.Topic == "":
+			return fmt.Errorf("column %q has no topic", column.Field)
+		case topics[column.Topic] != "":
+			return fmt.Errorf("columns %q and %q both write topic %q", topics[column.Topic], column.Field, column.Topic)
+		}
+		topics[column.Topic] = column.Field
+	}
+	return nil
+}
 
-			return errorCode["collision"]
+// scrapeDatapoint returns the JSON lines with keys and values of a datapoint,
+// from its command, or from its query
+func scrapeDatapoint(cfg *Config, dp *Datapoint, window periodWindow) (string, error) {
+	if dp.Prometheus != nil {
+		return dp.Prometheus.lines(cfg.PrometheusURL, window)
+	}
+	if dp.SQL != nil {
+		keys := len(dp.KeyFields)
+		if keys == 0 {
+			keys = 1
 		}
+		return dp.SQL.lines(window, keys)
 	}
-	logit.WithFields(log.Fields{
-		"cell": cell, "kpi": kpi.Title,
-	}).Info(action)
 
-	vr.Values[0] = value
-	_, err := srv.Spreadsheets.Values.Update(cfg.SpreadsheetID, cell, vr).ValueInputOption("USER_ENTERED").Do()
+	// Run KPI colleting command
+	cmd := exec.Command(dp.Command, dp.Args)
+	out, err := cmd.CombinedOutput()
 	if err != nil {
+		return "", fmt.Errorf("running external command %s %s: %w", dp.Command, dp.Args, err)
+	}
+	return string(out), nil
+}
+
+// writeSheetCell queues a sheet cell update with a specified value. The
+// existing cell value is needed to not overwrite it, and for a dry run.
+func writeSheetCell(kpi *KPIs, action string, value []interface{}, cell string,
+	existing interface{}, cfg *Config, batch *writeBatch, plan *syncPlan, overwrite int) int {
+
+	// A value exists but is not the same as we got
+	if overwrite == 0 && existing != nil && !sameValue(existing, value[0]) {
 		logit.WithFields(log.Fields{
-			"kpi":         kpi.Title,
-			"error":       err,
+			"cell":        cell,
 			"spreadsheet": cfg.SpreadsheetID,
-			"sheet":       cell,
-			"value":       value,
-		}).Fatal("Writing sheet cell")
+			"cellValue":   existing,
+			"newValue":    value[0],
+		}).Warning("Skip ", action)
+
+		return errorCode["collision"]
+	}
+	if cfg.DryRun == "yes" {
+		plan.add(kpi.Title, cell, existing, value[0])
 		return errorCode["synced"]
 	}
-	return errorCode["failed"]
+	logit.WithFields(log.Fields{
+		"cell": cell, "kpi": kpi.Title,
+	}).Info(action)
+
+	batch.add(kpi.Title, cell, [][]interface{}{value})
+	return errorCode["synced"]
 }
 
-func scrapeToJSON(uri string, dataPicker string) int {
+// scrapeToJSON fetches a JSON document and picks the text of a value from it,
+// failing on a status other than 2xx or when there is nothing to pick
+func scrapeToJSON(uri string, dataPicker string, request *HTTPRequest) (string, error) {
 	if len(uri) == 0 {
-		return -1
-	}
-
-	// Create HTTP client with timeout
-	client := &http.Client{
-		Timeout: 30 * time.Second,
+		return "", errNoDataSource
 	}
 
-	// Make request
-	response, err := client.Get(uri)
+	dataInBytes, err := request.get(uri)
 	if err != nil {
-		logit.Fatal(err)
+		return "", err
 	}
-	defer func() { _ = response.Body.Close() }()
+	pageContent := string(dataInBytes)
 	logit.WithFields(log.Fields{
-		"body": response.Body,
+		"body": snippet(dataInBytes),
 	}).Debug("Response body")
 
-	// Get the response body as a string
-	dataInBytes, err := ioutil.ReadAll(response.Body)
-	pageContent := string(dataInBytes)
-
-	if err != nil {
-		logit.Fatal(err)
-	}
-
+	// Keep numbers as written, gjson would round them to a float64
 	value := gjson.Get(pageContent, dataPicker)
-
-	var out int
-	_, _ = fmt.Sscanf(value.String(), "%d", &out)
-
-	return out
+	if !value.Exists() || value.Type == gjson.Null {
+		return "", fmt.Errorf("no value at %q in the response of %s", dataPicker, uri)
+	}
+	if value.Type == gjson.Number {
+		return value.Raw, nil
+	}
+	return value.String(), nil
 }
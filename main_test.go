@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// currentWeek returns the topic updateGoogleSheetKPI writes to this week
+func currentWeek() string {
+	year, week := time.Now().UTC().ISOWeek()
+	return fmt.Sprintf("%d-%02d", year, week)
+}
+
+func kpiTestConfig() *Config {
+	return &Config{
+		SpreadsheetID:      fakeSpreadsheetID,
+		SheetName:          "KPI data",
+		SheetLastUpdateCol: "B",
+		SheetKeyCol:        "C",
+		SheetTopicRow:      "2",
+		SheetDataStartRow:  "3",
+	}
+}
+
+func datapointTestConfig() *Config {
+	return &Config{
+		SpreadsheetID:     fakeSpreadsheetID,
+		SheetName:         "Deployments",
+		SheetKeyCol:       "A",
+		SheetTopicRow:     "1",
+		SheetDataStartRow: "2",
+		Datapoints: []Datapoint{{
+			Title:   "maxReplica",
+			Command: "cat",
+			Args:    "testdata/replicas.jsonl",
+		}},
+	}
+}
+
+func TestUpdateGoogleSheetKPI(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1581097668.761,"321"]}]}}`)
+	}))
+	defer prom.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Command KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "42"},
+		{Title: "JSON KPI", SheetRow: "4", JSONEndpoint: prom.URL, JSONDataPicker: "data.result.0.value.1"},
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "2000-01", currentWeek()})
+	fake.set("KPI data", "C4", []interface{}{"JSON KPI"})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	for cell, want := range map[string]interface{}{
+		"C3": "Command KPI",
+		"E3": 42.0,
+		"B3": today,
+		"C4": "JSON KPI",
+		"E4": 321.0,
+		"B4": today,
+		"D3": nil,
+	} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(KPIValue.WithLabelValues("JSON KPI")); got != 321 {
+		t.Errorf("kpi_value = %v, want 321", got)
+	}
+	if got := testutil.ToFloat64(KPILastSuccessTimestamp.WithLabelValues("Command KPI")); got == 0 {
+		t.Error("kpi_last_success_timestamp_seconds is not set")
+	}
+}
+
+func TestUpdateGoogleSheetKPIBatchesRequests(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	for i := 3; i < 63; i++ {
+		cfg.KPI = append(cfg.KPI, KPIs{Title: fmt.Sprintf("KPI %d", i), SheetRow: fmt.Sprint(i),
+			KPICommand: "echo", KPICommandArgs: fmt.Sprint(i)})
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", currentWeek()})
+
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()}); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+
+	// The topic row, the titles and a single batch update
+	if got := fake.count(http.MethodGet); got != 2 {
+		t.Errorf("got %d reads, want 2", got)
+	}
+	if got := fake.count(http.MethodPost); got != 1 {
+		t.Errorf("got %d batch updates, want 1", got)
+	}
+	if got := fake.get("KPI data", "D62"); got != 62.0 {
+		t.Errorf("cell D62 = %v, want 62", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIFloatValues(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	prom := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"data":{"availability":"97.35","cost":1234.5678}}`)
+	}))
+	defer prom.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Availability", SheetRow: "3", JSONEndpoint: prom.URL, JSONDataPicker: "data.availability"},
+		{Title: "Cost", SheetRow: "4", JSONEndpoint: prom.URL, JSONDataPicker: "data.cost", Precision: "1"},
+		{Title: "Garbage", SheetRow: "5", JSONEndpoint: prom.URL, JSONDataPicker: "data.missing"},
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", currentWeek()})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+	if len(summary.Errors["Garbage"]) != 1 {
+		t.Errorf("errors = %v, want an error for the missing value", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{"D3": 97.35, "D4": 1234.6, "D5": nil} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(KPIValue.WithLabelValues("Availability")); got != 97.35 {
+		t.Errorf("kpi_value = %v, want 97.35", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIMonthlyPeriod(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.Period = "month"
+	cfg.PeriodFormat = "Jan 2006"
+	cfg.KPI = []KPIs{{Title: "Board KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "12"}}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "Jan 2020", "Feb 2020"})
+
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC)
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at}); summary.Failed() {
+		t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+	}
+	if got := fake.get("KPI data", "E3"); got != 12.0 {
+		t.Errorf("cell E3 = %v, want 12", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIKeepsConflictingTitle(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "New title", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "7"}}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", currentWeek()})
+	fake.set("KPI data", "C3", []interface{}{"Old title"})
+
+	updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+
+	if got := fake.get("KPI data", "C3"); got != "Old title" {
+		t.Errorf("title = %v, want it left untouched", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIContinuesAfterFailure(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Broken KPI", SheetRow: "3", KPICommand: "false"},
+		{Title: "No source KPI", SheetRow: "4"},
+		{Title: "Working KPI", SheetRow: "5", KPICommand: "echo", KPICommandArgs: "9"},
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", currentWeek()})
+
+	scrapeErrors := testutil.ToFloat64(KPIScrapeErrors.WithLabelValues("Broken KPI"))
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+
+	if got := testutil.ToFloat64(KPIScrapeErrors.WithLabelValues("Broken KPI")); got != scrapeErrors+1 {
+		t.Errorf("kpi_scrape_errors_total = %v, want %v", got, scrapeErrors+1)
+	}
+	if !summary.Failed() || len(summary.Errors["Broken KPI"]) != 1 {
+		t.Errorf("errors = %v, want one error for Broken KPI", summary.Errors)
+	}
+	if len(summary.Synced) != 1 || summary.Synced[0] != "Working KPI" {
+		t.Errorf("synced = %v, want [Working KPI]", summary.Synced)
+	}
+	if len(summary.Skipped) != 1 || summary.Skipped[0] != "No source KPI" {
+		t.Errorf("skipped = %v, want [No source KPI]", summary.Skipped)
+	}
+	if got := fake.get("KPI data", "D5"); got != 9.0 {
+		t.Errorf("cell D5 = %v, want 9", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIMissingWeek(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "1"}}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "2000-01"})
+
+	if summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()}); summary.Err == nil {
+		t.Error("want the run to abort when the week column is missing")
+	}
+}
+
+func TestUpdateGoogleSheetKPIBackfill(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Empty KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "5"},
+		{Title: "Filled KPI", SheetRow: "4", KPICommand: "echo", KPICommandArgs: "6"},
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "2020-06", "2020-07"})
+	fake.set("KPI data", "B4", []interface{}{"2020-02-13", "Filled KPI", 1, 2})
+
+	at := time.Date(2020, 2, 5, 0, 0, 0, 0, time.UTC) // Week 2020-06
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: at, Backfill: true})
+	if summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+
+	for cell, want := range map[string]interface{}{
+		"D3": 5.0,          // Empty cell in the backfilled week is set
+		"D4": 1,            // Existing value is kept
+		"B3": nil,          // Last updated date is left alone
+		"B4": "2020-02-13", // Last updated date is left alone
+	} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetKPIBackfillRange(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	var queries []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("time"))
+		fmt.Fprint(w, `{"value": 42}`)
+	}))
+	defer endpoint.Close()
+
+	cfg := kpiTestConfig()
+	cfg.KPI = []KPIs{
+		{Title: "Templated", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "{period-end-unix}"},
+		{Title: "Env", SheetRow: "4", KPICommand: "printenv", KPICommandArgs: "KPI_PERIOD_START_UNIX"},
+		{Title: "JSON", SheetRow: "5", JSONEndpoint: endpoint.URL + "?time={period-end}", JSONDataPicker: "value"},
+	}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", "2020-06", "2020-07"})
+
+	periods, _ := newPeriodFormat(cfg)
+	targets, err := backfillTargets(periods, "2020-02-05", "2020-02-13")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range targets {
+		if summary := updateGoogleSheetKPI(cfg, fake.sink(), target); summary.Failed() {
+			t.Fatalf("run failed: %v %v", summary.Err, summary.Errors)
+		}
+	}
+
+	for cell, want := range map[string]interface{}{
+		"D3": 1581292800.0, "E3": 1581897600.0, // The end of the period
+		"D4": 1580688000.0, "E4": 1581292800.0, // The start of the period
+		"D5": 42.0, "E5": 42.0,
+	} {
+		if got := fake.get("KPI data", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+	if want := []string{"2020-02-10T00:00:00Z", "2020-02-17T00:00:00Z"}; fmt.Sprint(queries) != fmt.Sprint(want) {
+		t.Errorf("endpoint times = %q, want %q", queries, want)
+	}
+}
+
+func TestUpdateGoogleSheetValues(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"app1", 1.0},
+		[]interface{}{"app2"},
+		[]interface{}{"app3", 8.0})
+
+	synced := testutil.ToFloat64(DataUploadedToSheet.WithLabelValues(syncStatusSynced))
+	if summary := updateGoogleSheetValues(datapointTestConfig(), fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+
+	if got := testutil.ToFloat64(DataUploadedToSheet.WithLabelValues(syncStatusSynced)); got != synced+2 {
+		t.Errorf("synced datapoints = %v, want %v", got, synced+2)
+	}
+	for cell, want := range map[string]interface{}{
+		"B2": 3.0,
+		"B3": 5.0,
+		"B4": 8.0,
+		"B5": nil,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesRetriesQuotaErrors(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"app1"},
+		[]interface{}{"app2"})
+	fake.failNext(http.MethodPost, 2, http.StatusTooManyRequests)
+
+	if summary := updateGoogleSheetValues(datapointTestConfig(), fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+
+	if got := fake.count(http.MethodPost); got != 3 {
+		t.Errorf("got %d batch updates, want 3", got)
+	}
+	if got := fake.get("Deployments", "B3"); got != 5.0 {
+		t.Errorf("cell B3 = %v, want 5", got)
+	}
+}
+
+func TestUpdateGoogleSheetKPIDryRun(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	cfg := kpiTestConfig()
+	cfg.DryRun = "yes"
+	cfg.KPI = []KPIs{{Title: "KPI", SheetRow: "3", KPICommand: "echo", KPICommandArgs: "42"}}
+	fake.set("KPI data", "A2", []interface{}{"", "Last update", "KPI", currentWeek()})
+	fake.set("KPI data", "A3", []interface{}{"", "2000-01-01", "KPI", 41.0})
+
+	summary := updateGoogleSheetKPI(cfg, fake.sink(), syncTarget{At: time.Now()})
+
+	if got := fake.count(http.MethodPost); got != 0 {
+		t.Errorf("got %d writes in a dry run", got)
+	}
+	want := []plannedChange{
+		{Cell: "KPI data!D3", Title: "KPI", Old: 41.0, New: int64(42)},
+		{Cell: "KPI data!B3", Title: "KPI", Old: "2000-01-01", New: time.Now().Format("2006-01-02")},
+	}
+	if len(summary.Plan.Changes) != len(want) {
+		t.Fatalf("plan = %+v, want %+v", summary.Plan.Changes, want)
+	}
+	for i, c := range summary.Plan.Changes {
+		if c != want[i] {
+			t.Errorf("change %d = %+v, want %+v", i, c, want[i])
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesDryRun(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"app1", 3.0},
+		[]interface{}{"app2", 4.0})
+	cfg := datapointTestConfig()
+	cfg.DryRun = "yes"
+
+	summary := updateGoogleSheetValues(cfg, fake.sink())
+
+	if got := fake.count(http.MethodPost); got != 0 {
+		t.Errorf("got %d writes in a dry run", got)
+	}
+	want := plannedChange{Cell: "Deployments!B3", Title: "maxReplica", Old: 4.0, New: "5"}
+	if len(summary.Plan.Changes) != 1 || summary.Plan.Changes[0] != want {
+		t.Errorf("plan = %+v, want [%+v]", summary.Plan.Changes, want)
+	}
+}
+
+func TestUpdateGoogleSheetValuesColumns(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "cpuRequest", "maxReplica"},
+		[]interface{}{"app1", 1.0},
+		[]interface{}{"app2"})
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{{
+		Title:   "deployments",
+		Command: "cat",
+		Args:    "testdata/deployments.jsonl",
+		Columns: map[string]string{"cpu": "cpuRequest", "replicas": "maxReplica"},
+	}}
+
+	scrapes := testutil.ToFloat64(ReadEndpointData)
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	if got := testutil.ToFloat64(ReadEndpointData); got != scrapes+1 {
+		t.Errorf("ran the command %v times, want once", got-scrapes)
+	}
+	if got := fake.count(http.MethodPost); got != 1 {
+		t.Errorf("got %d batch updates, want 1", got)
+	}
+	for cell, want := range map[string]interface{}{
+		"B2": 2.0,
+		"C2": 3.0,
+		"B3": 0.5,
+		"C3": 5.0,
+		"A4": nil,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+
+	// New keys get one row, also when the key column is written
+	cfg.Datapoints[0].AddRows = "yes"
+	cfg.Datapoints[0].Columns["key"] = "app"
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"A4": "app3",
+		"B4": nil,
+		"C4": 1.0,
+		"A5": nil,
+		"C5": nil,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+
+	// A missing topic column fails the datapoint without writing
+	fake.set("Deployments", "C1", []interface{}{"replicas"})
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Errors["deployments"] == nil {
+		t.Errorf("missing topic column did not fail, errors %v", summary.Errors)
+	}
+}
+
+func TestUpdateGoogleSheetValuesAddRowsSharedKeyCol(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica", "cpuRequest"},
+		[]interface{}{"app1"},
+		[]interface{}{"app2"})
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{{
+		Title:   "maxReplica",
+		Command: "cat",
+		Args:    "testdata/replicas.jsonl",
+		AddRows: "yes",
+		Columns: map[string]string{"key": "app", "val": "maxReplica"},
+	}, {
+		Title:   "cpuRequest",
+		Command: "cat",
+		Args:    "testdata/deployments.jsonl",
+		AddRows: "yes",
+		Columns: map[string]string{"key": "app", "cpu": "cpuRequest"},
+	}}
+
+	// The second datapoint keeps the row the first one added
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"A4": "unknown", "B4": 1.0,
+		"A5": "app3", "C5": nil,
+		"B2": 3.0, "C2": 2.0,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
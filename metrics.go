@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -52,6 +53,43 @@ var (
 		},
 		[]string{"status"},
 	)
+
+	// KPIValue is the last scraped value per KPI
+	KPIValue = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "kpi_value",
+			Namespace: namespace,
+			Help:      "last scraped value of a KPI",
+		},
+		[]string{"kpi"},
+	)
+	// KPILastSuccessTimestamp is when a KPI or datapoint was last synced without errors
+	KPILastSuccessTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "kpi_last_success_timestamp_seconds",
+			Namespace: namespace,
+			Help:      "unix time of the last successful sync of a KPI or datapoint",
+		},
+		[]string{"kpi"},
+	)
+	// SheetsRateLimitWaitSeconds is the time spent waiting for the client side rate limiter
+	SheetsRateLimitWaitSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "sheets_rate_limit_wait_seconds_total",
+			Namespace: namespace,
+			Help:      "total time Sheets API calls waited for the rate limiter",
+		},
+		[]string{"group"},
+	)
+	// KPIScrapeErrors counts failed commands and endpoint scrapes per KPI or datapoint
+	KPIScrapeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "kpi_scrape_errors_total",
+			Namespace: namespace,
+			Help:      "total count of failed scrapes of a KPI or datapoint",
+		},
+		[]string{"kpi"},
+	)
 )
 
 func init() {
@@ -59,10 +97,18 @@ func init() {
 		SyncRunDurationSeconds,
 		ReadEndpointData,
 		DataUploadedToSheet,
+		KPIValue,
+		KPILastSuccessTimestamp,
+		KPIScrapeErrors,
+		SheetsRateLimitWaitSeconds,
 	)
 }
 
 func isAlive(w http.ResponseWriter, r *http.Request) {
+	if health.stuck(time.Now()) {
+		http.Error(w, "Sync stuck.", http.StatusServiceUnavailable)
+		return
+	}
 	_, err := fmt.Fprint(w, "Alive.")
 	if err != nil {
 		logit.WithFields(log.Fields{
@@ -74,21 +120,31 @@ func isAlive(w http.ResponseWriter, r *http.Request) {
 }
 
 func isReady(w http.ResponseWriter, r *http.Request) {
+	if !health.ready() {
+		http.Error(w, "Not ready.", http.StatusServiceUnavailable)
+		return
+	}
 	_, err := fmt.Fprint(w, "Ready.")
 	if err != nil {
 		logit.Error("error when responding with ready", err)
 	}
 }
 
-// Serve metrics and health endpoints
-func Serve(address, metrics, ready, alive string, log log.FieldLogger) {
+// Serve metrics and health endpoints, the health endpoint is optional
+func Serve(address, metrics, ready, alive, healthPath string, log log.FieldLogger) {
 	h := http.NewServeMux()
 	h.Handle(metrics, promhttp.Handler())
 	h.HandleFunc(ready, isReady)
 	h.HandleFunc(alive, isAlive)
+	if healthPath != "" {
+		h.HandleFunc(healthPath, isHealthy)
+	}
 	logit.Infof("HTTP server started on %s", address)
 	logit.Infof("serving metrics on %s", metrics)
 	logit.Infof("serving readiness check on %s", ready)
 	logit.Infof("serving liveness check on %s", alive)
+	if healthPath != "" {
+		logit.Infof("serving health report on %s", healthPath)
+	}
 	logit.Info(http.ListenAndServe(address, h))
 }
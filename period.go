@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default topic formats per period. Besides the Go time layout, formats
+// can use {isoyear} and {week} for the ISO year and week, and {quarter}.
+var periodFormats = map[string]string{
+	"day":     "2006-01-02",
+	"week":    "{isoyear}-{week}",
+	"month":   "2006-01",
+	"quarter": "2006-Q{quarter}",
+	"year":    "2006",
+}
+
+// periodFormat maps a time to the topic, i.e "2020-07", of the period
+// holding it
+type periodFormat struct {
+	period   string // "day", "week", "month", "quarter" or "year"
+	format   string
+	location *time.Location
+}
+
+// newPeriodFormat creates the period format from the period, period-format
+// and time-zone config fields. Periods default to ISO weeks in UTC.
+func newPeriodFormat(cfg *Config) (*periodFormat, error) {
+	p := &periodFormat{period: cfg.Period, format: cfg.PeriodFormat, location: time.UTC}
+	if p.period == "" {
+		p.period = "week"
+	}
+	if _, ok := periodFormats[p.period]; !ok {
+		return nil, fmt.Errorf("period %q is not day, week, month, quarter or year", cfg.Period)
+	}
+	if p.format == "" {
+		p.format = periodFormats[p.period]
+	}
+	if cfg.TimeZone != "" {
+		var err error
+		if p.location, err = time.LoadLocation(cfg.TimeZone); err != nil {
+			return nil, fmt.Errorf("time-zone %q: %w", cfg.TimeZone, err)
+		}
+	}
+	return p, nil
+}
+
+// topic returns the topic of the period holding t
+func (p *periodFormat) topic(t time.Time) string {
+	t = t.In(p.location)
+	year, week := t.ISOWeek()
+	return strings.NewReplacer(
+		"{isoyear}", fmt.Sprintf("%d", year),
+		"{week}", fmt.Sprintf("%02d", week),
+		"{quarter}", fmt.Sprintf("%d", (int(t.Month())+2)/3),
+	).Replace(t.Format(p.format))
+}
+
+// start returns the start of the period holding t
+func (p *periodFormat) start(t time.Time) time.Time {
+	t = t.In(p.location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, p.location)
+	switch p.period {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7) // Back to monday
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day())
+	case "quarter":
+		return time.Date(t.Year(), t.Month()-(t.Month()-1)%3, 1, 0, 0, 0, 0, p.location)
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, p.location)
+	}
+	return day
+}
+
+// next returns the start of the period after the one holding t
+func (p *periodFormat) next(t time.Time) time.Time {
+	start := p.start(t)
+	switch p.period {
+	case "week":
+		return start.AddDate(0, 0, 7)
+	case "month":
+		return start.AddDate(0, 1, 0)
+	case "quarter":
+		return start.AddDate(0, 3, 0)
+	case "year":
+		return start.AddDate(1, 0, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// previous returns the start of the period before the one holding t
+func (p *periodFormat) previous(t time.Time) time.Time {
+	return p.start(p.start(t).AddDate(0, 0, -1))
+}
+
+// periodWindow is the period a KPI source is asked about
+type periodWindow struct {
+	Topic string
+	Start time.Time
+	End   time.Time // The end of the period, or now for the current one
+}
+
+// window returns the period holding t, ending at now if it has not ended
+func (p *periodFormat) window(t, now time.Time) periodWindow {
+	end := p.next(t)
+	if end.After(now) {
+		end = now
+	}
+	return periodWindow{Topic: p.topic(t), Start: p.start(t), End: end}
+}
+
+// values returns the template fields of the window
+func (w periodWindow) values() map[string]string {
+	return map[string]string{
+		"period":            w.Topic,
+		"period-start":      w.Start.Format(time.RFC3339),
+		"period-end":        w.End.Format(time.RFC3339),
+		"period-start-unix": strconv.FormatInt(w.Start.Unix(), 10),
+		"period-end-unix":   strconv.FormatInt(w.End.Unix(), 10),
+	}
+}
+
+// expand replaces {period}, {period-start}, {period-end},
+// {period-start-unix} and {period-end-unix} in s, with the values passed
+// through escape, i.e url.QueryEscape for an URL
+func (w periodWindow) expand(s string, escape func(string) string) string {
+	var pairs []string
+	for name, value := range w.values() {
+		pairs = append(pairs, "{"+name+"}", escape(value))
+	}
+	return strings.NewReplacer(pairs...).Replace(s)
+}
+
+// env returns the window as KPI_PERIOD, KPI_PERIOD_START and so on, for
+// the environment of a KPI command
+func (w periodWindow) env() []string {
+	var env []string
+	for name, value := range w.values() {
+		env = append(env, "KPI_"+strings.ToUpper(strings.Replace(name, "-", "_", -1))+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeriodFormat(t *testing.T) {
+	at := time.Date(2020, 2, 13, 23, 30, 0, 0, time.UTC) // Thursday of week 7
+	for _, test := range []struct {
+		cfg   Config
+		topic string
+		start time.Time
+		next  time.Time
+	}{
+		{Config{}, "2020-07", time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "day"}, "2020-02-13", time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 14, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "month"}, "2020-02", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "quarter"}, "2020-Q1", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "year"}, "2020", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "month", PeriodFormat: "Jan 2006"}, "Feb 2020", time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{Config{Period: "week", PeriodFormat: "W{week} {isoyear}"}, "W07 2020", time.Date(2020, 2, 10, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 17, 0, 0, 0, 0, time.UTC)},
+	} {
+		p, err := newPeriodFormat(&test.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.topic(at); got != test.topic {
+			t.Errorf("%s topic = %q, want %q", p.period, got, test.topic)
+		}
+		if got := p.start(at); !got.Equal(test.start) {
+			t.Errorf("%s start = %v, want %v", p.period, got, test.start)
+		}
+		if got := p.next(at); !got.Equal(test.next) {
+			t.Errorf("%s next = %v, want %v", p.period, got, test.next)
+		}
+	}
+}
+
+func TestPeriodFormatTimeZone(t *testing.T) {
+	p, err := newPeriodFormat(&Config{Period: "day", TimeZone: "Asia/Tokyo"})
+	if err != nil {
+		t.Skip("no time zone database: ", err)
+	}
+	at := time.Date(2020, 12, 31, 20, 0, 0, 0, time.UTC) // Already new year in Tokyo
+	if got := p.topic(at); got != "2021-01-01" {
+		t.Errorf("topic = %q, want 2021-01-01", got)
+	}
+
+	// The ISO year of the last days of December can be the next year
+	p, _ = newPeriodFormat(&Config{})
+	if got := p.topic(time.Date(2019, 12, 30, 12, 0, 0, 0, time.UTC)); got != "2020-01" {
+		t.Errorf("topic = %q, want 2020-01", got)
+	}
+}
+
+func TestNewPeriodFormatErrors(t *testing.T) {
+	for _, cfg := range []Config{{Period: "fortnight"}, {TimeZone: "Nowhere/Special"}} {
+		if _, err := newPeriodFormat(&cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestPeriodWindow(t *testing.T) {
+	p, err := newPeriodFormat(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC)
+
+	w := p.window(at, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+	if got, want := w.expand("{period} {period-start} {period-end-unix} {job}", func(s string) string { return s }),
+		"2020-07 2020-02-10T00:00:00Z 1581897600 {job}"; got != want {
+		t.Errorf("expand = %q, want %q", got, want)
+	}
+	if got, want := w.expand("time={period-end}", url.QueryEscape), "time=2020-02-17T00%3A00%3A00Z"; got != want {
+		t.Errorf("escaped expand = %q, want %q", got, want)
+	}
+	wantEnv := []string{
+		"KPI_PERIOD=2020-07",
+		"KPI_PERIOD_END=2020-02-17T00:00:00Z",
+		"KPI_PERIOD_END_UNIX=1581897600",
+		"KPI_PERIOD_START=2020-02-10T00:00:00Z",
+		"KPI_PERIOD_START_UNIX=1581292800",
+	}
+	if got := w.env(); strings.Join(got, " ") != strings.Join(wantEnv, " ") {
+		t.Errorf("env = %q, want %q", got, wantEnv)
+	}
+
+	// The current period ends now
+	now := time.Date(2020, 2, 14, 12, 0, 0, 0, time.UTC)
+	if got := p.window(at, now).End; !got.Equal(now) {
+		t.Errorf("current period end = %v, want %v", got, now)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// plannedChange is a cell a dry run would change
+type plannedChange struct {
+	Cell  string      `json:"cell"` // A1 notation, i.e "KPI data!K7"
+	Title string      `json:"kpi"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+}
+
+// syncPlan holds the cell changes of a dry run
+type syncPlan struct {
+	Changes []plannedChange
+}
+
+// add records a change of a cell, unless the value stays the same
+func (p *syncPlan) add(title, cell string, old, new interface{}) {
+	if old == nil {
+		old = ""
+	}
+	if sameValue(old, new) {
+		return
+	}
+	p.Changes = append(p.Changes, plannedChange{
+		Cell:  singleCell(cell),
+		Title: title,
+		Old:   old,
+		New:   new,
+	})
+}
+
+// print writes the plan as an aligned text table or as JSON
+func (p *syncPlan) print(w io.Writer, format string) error {
+	switch format {
+	case "json":
+		changes := p.Changes
+		if changes == nil {
+			changes = []plannedChange{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	case "", "text":
+		if len(p.Changes) == 0 {
+			_, err := fmt.Fprintln(w, "No changes.")
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "CELL\tKPI\tOLD\tNEW")
+		for _, c := range p.Changes {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%q\t%q\n", c.Cell, c.Title,
+				fmt.Sprintf("%v", c.Old), fmt.Sprintf("%v", c.New))
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%d cell(s) to change.\n", len(p.Changes))
+		return err
+	}
+	return fmt.Errorf("unknown plan format %q, use text or json", format)
+}
+
+// singleCell shortens a single cell range like "KPI data!K7:K7" to "KPI data!K7"
+func singleCell(cellRange string) string {
+	sheet := ""
+	if i := strings.LastIndex(cellRange, "!"); i >= 0 {
+		sheet, cellRange = cellRange[:i+1], cellRange[i+1:]
+	}
+	if parts := strings.Split(cellRange, ":"); len(parts) == 2 && parts[0] == parts[1] {
+		cellRange = parts[0]
+	}
+	return sheet + cellRange
+}
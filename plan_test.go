@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSyncPlanAdd(t *testing.T) {
+	var plan syncPlan
+	plan.add("KPI", "KPI data!K7:K7", 321.0, 321)
+	plan.add("KPI", "KPI data!K8:K8", nil, 5)
+
+	if len(plan.Changes) != 1 {
+		t.Fatalf("got %d changes, want only the changed cell", len(plan.Changes))
+	}
+	if c := plan.Changes[0]; c.Cell != "KPI data!K8" || c.Old != "" || c.New != 5 {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestSyncPlanPrint(t *testing.T) {
+	plan := syncPlan{Changes: []plannedChange{
+		{Cell: "KPI data!K7", Title: "Servers", Old: 320.0, New: 321},
+	}}
+
+	var text bytes.Buffer
+	if err := plan.print(&text, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text.String(), `KPI data!K7  Servers  "320"  "321"`) {
+		t.Errorf("text plan:\n%s", text.String())
+	}
+
+	var out bytes.Buffer
+	if err := plan.print(&out, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var changes []map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &changes); err != nil {
+		t.Fatalf("decoding %s: %v", out.String(), err)
+	}
+	if len(changes) != 1 || changes[0]["cell"] != "KPI data!K7" || changes[0]["kpi"] != "Servers" {
+		t.Errorf("json plan = %v", changes)
+	}
+
+	if err := plan.print(&out, "yaml"); err == nil {
+		t.Error("want an error for an unknown format")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// PrometheusQuery is a PromQL query against the Prometheus HTTP API, as
+// the source of a KPI or datapoint
+type PrometheusQuery struct {
+	URL          string   `yaml:"url"`           // Server URL, defaults to prometheus-url
+	Query        string   `yaml:"query"`         // PromQL, can use the period templates
+	Time         string   `yaml:"time"`          // Evaluation time, defaults to the end of the period
+	Step         string   `yaml:"step"`          // Query the whole period at this resolution, i.e "1h"
+	Aggregate    string   `yaml:"aggregate"`     // Combine series and samples, see prometheusAggregates
+	KeyLabels    []string `yaml:"key-labels"`    // Labels making the key of a datapoint
+	KeySeparator string   `yaml:"key-separator"` // Between the key labels, default "/"
+
+	HTTPRequest `yaml:",inline"` // Headers, auth and TLS, queries are always a GET
+}
+
+// prometheusAggregates combine the samples of a query result
+var prometheusAggregates = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "first": true, "last": true,
+}
+
+// prometheusResponse is the envelope of /api/v1/query and /api/v1/query_range
+type prometheusResponse struct {
+	Status    string   `json:"status"`
+	ErrorType string   `json:"errorType"`
+	Error     string   `json:"error"`
+	Warnings  []string `json:"warnings"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// prometheusSample is a sample of a series, the value is kept as the text
+// Prometheus sent, i.e "97.35" or "NaN"
+type prometheusSample struct {
+	at    float64
+	value string
+}
+
+// UnmarshalJSON decodes the [<unix time>, "<value>"] pair of a sample
+func (s *prometheusSample) UnmarshalJSON(b []byte) error {
+	var pair []interface{}
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("sample %s is not a time and value pair", b)
+	}
+	at, okAt := pair[0].(float64)
+	value, okValue := pair[1].(string)
+	if !okAt || !okValue {
+		return fmt.Errorf("sample %s is not a time and value pair", b)
+	}
+	s.at, s.value = at, value
+	return nil
+}
+
+// prometheusSeries is a vector or matrix result series
+type prometheusSeries struct {
+	Metric map[string]string  `json:"metric"`
+	Value  *prometheusSample  `json:"value"`  // Vector results
+	Values []prometheusSample `json:"values"` // Matrix results
+}
+
+// validate checks the query, with the server URL from prometheus-url when
+// not set. Datapoints need key labels.
+func (q *PrometheusQuery) validate(defaultURL string, datapoint bool) error {
+	if q.URL == "" && defaultURL == "" {
+		return fmt.Errorf("prometheus has no url and prometheus-url is not set")
+	}
+	if q.Query == "" {
+		return fmt.Errorf("prometheus has no query")
+	}
+	if q.Aggregate != "" && !prometheusAggregates[q.Aggregate] {
+		return fmt.Errorf("prometheus aggregate %q is not sum, avg, min, max, count, first or last", q.Aggregate)
+	}
+	if q.Step != "" {
+		if _, err := time.ParseDuration(q.Step); err != nil {
+			return fmt.Errorf("prometheus step %q: %w", q.Step, err)
+		}
+	}
+	if q.Time != "" && !strings.Contains(q.Time, "{") {
+		if _, err := parsePrometheusTime(q.Time); err != nil {
+			return err
+		}
+	}
+	if q.Method != "" || q.Body != "" {
+		return fmt.Errorf("prometheus queries are sent with GET and no body")
+	}
+	if err := q.HTTPRequest.validate(); err != nil {
+		return fmt.Errorf("prometheus %v", err)
+	}
+	if datapoint && len(q.KeyLabels) == 0 {
+		return fmt.Errorf("prometheus has no key-labels for the datapoint keys")
+	}
+	return nil
+}
+
+// value runs the query for a KPI, which has to give a single sample
+// unless aggregated
+func (q *PrometheusQuery) value(defaultURL string, window periodWindow) (string, error) {
+	samples, err := q.run(defaultURL, window)
+	if err != nil {
+		return "", err
+	}
+	var all []prometheusSample
+	for _, s := range samples {
+		all = append(all, s.samples...)
+	}
+	return q.aggregate(all)
+}
+
+// lines runs the query for a datapoint, and returns a JSON line with the
+// key and value per label set, as a datapoint command would
+func (q *PrometheusQuery) lines(defaultURL string, window periodWindow) (string, error) {
+	series, err := q.run(defaultURL, window)
+	if err != nil {
+		return "", err
+	}
+
+	// Series with the same key labels are combined
+	separator := q.KeySeparator
+	if separator == "" {
+		separator = "/"
+	}
+	var keys []string
+	byKey := make(map[string][]prometheusSample)
+	for _, s := range series {
+		var parts []string
+		for _, label := range q.KeyLabels {
+			parts = append(parts, s.metric[label])
+		}
+		key := strings.Join(parts, separator)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], s.samples...)
+	}
+	sort.Strings(keys)
+
+	var out strings.Builder
+	for _, key := range keys {
+		value, err := q.aggregate(byKey[key])
+		if err != nil {
+			return "", fmt.Errorf("key %q: %w", key, err)
+		}
+		line, _ := json.Marshal(map[string]string{"key": key, "val": value})
+		out.Write(line)
+		out.WriteString("\n")
+	}
+	return out.String(), nil
+}
+
+// labeledSamples are the samples of a series, or of a scalar result
+type labeledSamples struct {
+	metric  map[string]string
+	samples []prometheusSample
+}
+
+// run queries Prometheus, over the whole period window when a step is
+// set, and at the evaluation time otherwise
+func (q *PrometheusQuery) run(defaultURL string, window periodWindow) ([]labeledSamples, error) {
+	server := q.URL
+	if server == "" {
+		server = defaultURL
+	}
+	params := url.Values{}
+	params.Set("query", window.expand(q.Query, func(s string) string { return s }))
+	endpoint := strings.TrimSuffix(server, "/") + "/api/v1/query"
+	if q.Step != "" {
+		endpoint += "_range"
+		params.Set("start", strconv.FormatInt(window.Start.Unix(), 10))
+		params.Set("end", strconv.FormatInt(window.End.Unix(), 10))
+		params.Set("step", q.Step)
+	} else {
+		at := window.End
+		if q.Time != "" {
+			var err error
+			if at, err = parsePrometheusTime(window.expand(q.Time, func(s string) string { return s })); err != nil {
+				return nil, err
+			}
+		}
+		params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	}
+
+	status, body, err := q.HTTPRequest.fetch(endpoint + "?" + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+
+	// Failed queries come with an error envelope, but a proxy in
+	// front may answer with anything
+	var r prometheusResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		if status/100 != 2 {
+			return nil, fmt.Errorf("prometheus %s returned %d %s: %s", endpoint, status, http.StatusText(status), snippet(body))
+		}
+		return nil, fmt.Errorf("decoding the response of %s: %w", endpoint, err)
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("prometheus query %q failed with %s: %s", q.Query, r.ErrorType, r.Error)
+	}
+	for _, warning := range r.Warnings {
+		logit.WithFields(log.Fields{
+			"query":   q.Query,
+			"warning": warning,
+		}).Warning("Prometheus query warning")
+	}
+
+	switch r.Data.ResultType {
+	case "vector", "matrix":
+		var series []prometheusSeries
+		if err := json.Unmarshal(r.Data.Result, &series); err != nil {
+			return nil, fmt.Errorf("decoding the %s result of %q: %w", r.Data.ResultType, q.Query, err)
+		}
+		var result []labeledSamples
+		for _, s := range series {
+			samples := s.Values
+			if s.Value != nil {
+				samples = []prometheusSample{*s.Value}
+			}
+			result = append(result, labeledSamples{metric: s.Metric, samples: samples})
+		}
+		return result, nil
+	case "scalar":
+		var sample prometheusSample
+		if err := json.Unmarshal(r.Data.Result, &sample); err != nil {
+			return nil, fmt.Errorf("decoding the scalar result of %q: %w", q.Query, err)
+		}
+		return []labeledSamples{{samples: []prometheusSample{sample}}}, nil
+	}
+	return nil, fmt.Errorf("prometheus query %q gave an unsupported %q result", q.Query, r.Data.ResultType)
+}
+
+// aggregate combines samples into a single value. Without an aggregate
+// there has to be a single sample.
+func (q *PrometheusQuery) aggregate(samples []prometheusSample) (string, error) {
+	if len(samples) == 0 {
+		return "", fmt.Errorf("prometheus query %q gave no samples", q.Query)
+	}
+	switch q.Aggregate {
+	case "":
+		if len(samples) > 1 {
+			return "", fmt.Errorf("prometheus query %q gave %d samples, set an aggregate", q.Query, len(samples))
+		}
+		return samples[0].value, nil
+	case "count":
+		return strconv.Itoa(len(samples)), nil
+	case "first", "last":
+		pick := samples[0]
+		for _, s := range samples[1:] {
+			if (q.Aggregate == "first" && s.at < pick.at) || (q.Aggregate == "last" && s.at > pick.at) {
+				pick = s
+			}
+		}
+		return pick.value, nil
+	}
+
+	values := make([]*big.Rat, len(samples))
+	for i, s := range samples {
+		var ok bool
+		if values[i], ok = new(big.Rat).SetString(s.value); !ok {
+			return "", fmt.Errorf("prometheus sample %q is not a number", s.value)
+		}
+	}
+	result := values[0]
+	switch q.Aggregate {
+	case "sum", "avg":
+		result = new(big.Rat)
+		for _, v := range values {
+			result.Add(result, v)
+		}
+		if q.Aggregate == "avg" {
+			result.Quo(result, new(big.Rat).SetInt64(int64(len(values))))
+		}
+	case "min", "max":
+		for _, v := range values[1:] {
+			if (q.Aggregate == "min" && v.Cmp(result) < 0) || (q.Aggregate == "max" && v.Cmp(result) > 0) {
+				result = v
+			}
+		}
+	}
+	return ratText(result), nil
+}
+
+// parsePrometheusTime parses an evaluation time given as RFC 3339 or
+// unix seconds
+func parsePrometheusTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("prometheus time %q is not RFC 3339 or unix seconds", value)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePrometheus answers queries with a canned body, and records them
+type fakePrometheus struct {
+	*httptest.Server
+	status   int
+	body     string
+	requests []*http.Request
+}
+
+func newFakePrometheus(body string) *fakePrometheus {
+	f := &fakePrometheus{status: http.StatusOK, body: body}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.requests = append(f.requests, r)
+		w.WriteHeader(f.status)
+		fmt.Fprint(w, f.body)
+	}))
+	return f
+}
+
+func (f *fakePrometheus) lastQuery() url.Values {
+	return f.requests[len(f.requests)-1].URL.Query()
+}
+
+const (
+	prometheusVector = `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"app":"app1","env":"prod"},"value":[1581897600,"3"]},
+		{"metric":{"app":"app2","env":"prod"},"value":[1581897600,"4.5"]},
+		{"metric":{"app":"app1","env":"test"},"value":[1581897600,"1"]}]}}`
+	prometheusMatrix = `{"status":"success","data":{"resultType":"matrix","result":[
+		{"metric":{"app":"app1"},"values":[[1581292800,"90"],[1581595200,"100"],[1581897600,"95"]]}]}}`
+)
+
+func testWindow() periodWindow {
+	periods, _ := newPeriodFormat(&Config{})
+	at := time.Date(2020, 2, 13, 0, 0, 0, 0, time.UTC)
+	return periods.window(at, time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func TestPrometheusQueryValue(t *testing.T) {
+	prom := newFakePrometheus(`{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{},"value":[1581897600,"321"]}]}}`)
+	defer prom.Close()
+
+	q := &PrometheusQuery{Query: `count(up{job="node"})`}
+	got, err := q.value(prom.URL+"/", testWindow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "321" {
+		t.Errorf("value = %q, want 321", got)
+	}
+	query := prom.lastQuery()
+	if prom.requests[0].URL.Path != "/api/v1/query" || query.Get("query") != `count(up{job="node"})` ||
+		query.Get("time") != "1581897600" {
+		t.Errorf("request = %v, want an instant query at the end of the period", prom.requests[0].URL)
+	}
+}
+
+func TestPrometheusQueryAggregates(t *testing.T) {
+	prom := newFakePrometheus(prometheusVector)
+	defer prom.Close()
+
+	for aggregate, want := range map[string]string{
+		"sum":   "8.5",
+		"avg":   "2.8333333333333335",
+		"min":   "1",
+		"max":   "4.5",
+		"count": "3",
+		"first": "3",
+	} {
+		q := &PrometheusQuery{URL: prom.URL, Query: "up", Aggregate: aggregate}
+		got, err := q.value("", testWindow())
+		if err != nil {
+			t.Errorf("%s: %v", aggregate, err)
+		} else if got != want {
+			t.Errorf("%s = %q, want %q", aggregate, got, want)
+		}
+	}
+
+	q := &PrometheusQuery{URL: prom.URL, Query: "up"}
+	if _, err := q.value("", testWindow()); err == nil || !strings.Contains(err.Error(), "set an aggregate") {
+		t.Errorf("several series without an aggregate gave %v", err)
+	}
+}
+
+func TestPrometheusQueryRange(t *testing.T) {
+	prom := newFakePrometheus(prometheusMatrix)
+	defer prom.Close()
+
+	q := &PrometheusQuery{URL: prom.URL, Query: "avg(probe_success)*100", Step: "1h", Aggregate: "last"}
+	got, err := q.value("", testWindow())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "95" {
+		t.Errorf("value = %q, want 95", got)
+	}
+	query := prom.lastQuery()
+	if prom.requests[0].URL.Path != "/api/v1/query_range" || query.Get("start") != "1581292800" ||
+		query.Get("end") != "1581897600" || query.Get("step") != "1h" {
+		t.Errorf("request = %v, want a range query over the period", prom.requests[0].URL)
+	}
+}
+
+func TestPrometheusQueryTimeAndHeaders(t *testing.T) {
+	prom := newFakePrometheus(`{"status":"success","data":{"resultType":"scalar","result":[1581292800,"7"]}}`)
+	defer prom.Close()
+
+	os.Setenv("PROMETHEUS_TEST_TOKEN", "secret")
+	defer os.Unsetenv("PROMETHEUS_TEST_TOKEN")
+
+	q := &PrometheusQuery{
+		URL:   prom.URL,
+		Query: "scalar(up)",
+		Time:  "{period-start}",
+		HTTPRequest: HTTPRequest{
+			Headers: map[string]string{"Authorization": "Bearer ${PROMETHEUS_TEST_TOKEN}"},
+		},
+	}
+	if got, err := q.value("", testWindow()); err != nil || got != "7" {
+		t.Errorf("value = %q, %v, want 7", got, err)
+	}
+	if got := prom.lastQuery().Get("time"); got != "1581292800" {
+		t.Errorf("time = %s, want the start of the period", got)
+	}
+	if got := prom.requests[0].Header.Get("Authorization"); got != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the token from the environment", got)
+	}
+}
+
+func TestPrometheusQueryErrors(t *testing.T) {
+	prom := newFakePrometheus(`{"status":"error","errorType":"bad_data","error":"parse error at char 4"}`)
+	defer prom.Close()
+
+	q := &PrometheusQuery{URL: prom.URL, Query: "up{"}
+	prom.status = http.StatusBadRequest
+	if _, err := q.value("", testWindow()); err == nil || !strings.Contains(err.Error(), "bad_data: parse error") {
+		t.Errorf("error status gave %v", err)
+	}
+
+	prom.status, prom.body = http.StatusBadGateway, "<html>Bad gateway</html>"
+	if _, err := q.value("", testWindow()); err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("proxy error gave %v", err)
+	}
+
+	prom.status, prom.body = http.StatusOK, `{"status":"success","data":{"resultType":"vector","result":[]}}`
+	if _, err := q.value("", testWindow()); err == nil || !strings.Contains(err.Error(), "no samples") {
+		t.Errorf("empty result gave %v", err)
+	}
+}
+
+func TestUpdateGoogleSheetValuesPrometheus(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+	prom := newFakePrometheus(prometheusVector)
+	defer prom.Close()
+
+	cfg := datapointTestConfig()
+	cfg.PrometheusURL = prom.URL
+	cfg.Datapoints = []Datapoint{{
+		Title:      "maxReplica",
+		Prometheus: &PrometheusQuery{Query: "max by (app, env) (replicas)", KeyLabels: []string{"env", "app"}},
+	}}
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"prod/app1"},
+		[]interface{}{"prod/app2"},
+		[]interface{}{"test/app1"})
+
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"B2": 3.0,
+		"B3": 4.5,
+		"B4": 1.0,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestPrometheusQueryValidate(t *testing.T) {
+	for _, test := range []struct {
+		q         PrometheusQuery
+		datapoint bool
+		want      string
+	}{
+		{PrometheusQuery{Query: "up"}, false, "no url"},
+		{PrometheusQuery{URL: "http://prometheus"}, false, "no query"},
+		{PrometheusQuery{URL: "http://prometheus", Query: "up", Aggregate: "median"}, false, "aggregate"},
+		{PrometheusQuery{URL: "http://prometheus", Query: "up", Step: "often"}, false, "step"},
+		{PrometheusQuery{URL: "http://prometheus", Query: "up", Time: "yesterday"}, false, "time"},
+		{PrometheusQuery{URL: "http://prometheus", Query: "up"}, true, "key-labels"},
+	} {
+		err := test.q.validate("", test.datapoint)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate %+v = %v, want %q", test.q, err, test.want)
+		}
+	}
+	q := PrometheusQuery{Query: "up", Time: "{period-end-unix}"}
+	if err := q.validate("http://prometheus", false); err != nil {
+		t.Errorf("valid query: %v", err)
+	}
+}
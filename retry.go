@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/googleapi"
+)
+
+// retryPolicy decides how often and how long to wait before retrying a
+// failed Sheets API call, using exponential backoff with jitter
+type retryPolicy struct {
+	MaxAttempts int           // Attempts including the first call
+	BaseDelay   time.Duration // Delay before the first retry, doubled for each retry
+	MaxDelay    time.Duration // Cap on the backoff delay
+	Jitter      float64       // Fraction of the delay to randomize, 0 to 1
+
+	sleep func(time.Duration) // Replaced in tests
+}
+
+// defaultRetryPolicy follows the Google recommendation of a truncated
+// exponential backoff up to 64 seconds
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{
+		MaxAttempts: 6,
+		BaseDelay:   time.Second,
+		MaxDelay:    64 * time.Second,
+		Jitter:      0.5,
+		sleep:       time.Sleep,
+	}
+}
+
+// newRetryPolicy returns the default retry policy with the retry-* config
+// fields applied
+func newRetryPolicy(cfg *Config) (retryPolicy, error) {
+	p := defaultRetryPolicy()
+	var err error
+	if cfg.RetryMaxAttempts != "" {
+		if p.MaxAttempts, err = strconv.Atoi(cfg.RetryMaxAttempts); err != nil || p.MaxAttempts < 1 {
+			return p, fmt.Errorf("retry-max-attempts %q is not a positive number", cfg.RetryMaxAttempts)
+		}
+	}
+	if cfg.RetryBaseDelay != "" {
+		if p.BaseDelay, err = time.ParseDuration(cfg.RetryBaseDelay); err != nil {
+			return p, fmt.Errorf("retry-base-delay %q: %w", cfg.RetryBaseDelay, err)
+		}
+	}
+	if cfg.RetryMaxDelay != "" {
+		if p.MaxDelay, err = time.ParseDuration(cfg.RetryMaxDelay); err != nil {
+			return p, fmt.Errorf("retry-max-delay %q: %w", cfg.RetryMaxDelay, err)
+		}
+	}
+	if cfg.RetryJitter != "" {
+		if p.Jitter, err = strconv.ParseFloat(cfg.RetryJitter, 64); err != nil || p.Jitter < 0 || p.Jitter > 1 {
+			return p, fmt.Errorf("retry-jitter %q is not a number from 0 to 1", cfg.RetryJitter)
+		}
+	}
+	return p, nil
+}
+
+// do runs call until it succeeds, fails with an error which is not worth
+// retrying, or the attempts are used up
+func (p retryPolicy) do(what string, call func() error) error {
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = call()
+		retry, retryAfter := retryable(err)
+		if !retry || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		delay := p.delay(attempt)
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		logit.WithFields(log.Fields{
+			"call":    what,
+			"attempt": attempt,
+			"delay":   delay,
+			"error":   err,
+		}).Warning("Retrying Sheets API call")
+		p.sleep(delay)
+	}
+}
+
+// delay returns the backoff before retrying after the given attempt
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.BaseDelay) * math.Pow(2, float64(attempt-1))
+	if d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d -= d * p.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// retryable tells if a Sheets API error is worth retrying, which are quota
+// errors, server errors and timeouts, and how long the server asked us to wait
+func retryable(err error) (bool, time.Duration) {
+	if err == nil {
+		return false, 0
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable:
+			return true, parseRetryAfter(apiErr.Header.Get("Retry-After"), time.Now())
+		}
+		return false, 0
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as a date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second} {
+		if got := p.delay(attempt); got != want {
+			t.Errorf("delay after attempt %d = %v, want %v", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.delay(2); got < time.Second || got > 2*time.Second {
+			t.Fatalf("jittered delay %v not within 1s and 2s", got)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	header := http.Header{}
+	header.Set("Retry-After", "30")
+	for _, test := range []struct {
+		err        error
+		retry      bool
+		retryAfter time.Duration
+	}{
+		{&googleapi.Error{Code: 429, Header: header}, true, 30 * time.Second},
+		{&googleapi.Error{Code: 500}, true, 0},
+		{&googleapi.Error{Code: 503}, true, 0},
+		{&googleapi.Error{Code: 400}, false, 0},
+		{&googleapi.Error{Code: 403, Header: header}, false, 0},
+		{errors.New("Error 429"), false, 0},
+		{nil, false, 0},
+	} {
+		retry, retryAfter := retryable(test.err)
+		if retry != test.retry || retryAfter != test.retryAfter {
+			t.Errorf("retryable(%v) = %v, %v, want %v, %v", test.err, retry, retryAfter, test.retry, test.retryAfter)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 2, 13, 12, 0, 0, 0, time.UTC)
+	for value, want := range map[string]time.Duration{
+		"":                              0,
+		"120":                           2 * time.Minute,
+		"Thu, 13 Feb 2020 12:00:10 GMT": 10 * time.Second,
+		"Thu, 13 Feb 2020 11:00:00 GMT": 0,
+		"soon":                          0,
+	} {
+		if got := parseRetryAfter(value, now); got != want {
+			t.Errorf("parseRetryAfter(%q) = %v, want %v", value, got, want)
+		}
+	}
+}
+
+func TestNewRetryPolicy(t *testing.T) {
+	cfg := kpiTestConfig()
+	cfg.RetryMaxAttempts = "3"
+	cfg.RetryBaseDelay = "100ms"
+	p, err := newRetryPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MaxAttempts != 3 || p.BaseDelay != 100*time.Millisecond || p.MaxDelay != 64*time.Second {
+		t.Errorf("got %+v", p)
+	}
+
+	cfg.RetryJitter = "2"
+	if _, err := newRetryPolicy(cfg); err == nil {
+		t.Error("expected an error for a jitter above 1")
+	}
+}
+
+func TestSinkRetries(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+	fake.set("Data", "A1", []interface{}{"value"})
+	sink := fake.sink()
+
+	// Reads honour Retry-After when it is longer than the backoff
+	fake.retryAfter = "90"
+	fake.failNext(http.MethodGet, 2, http.StatusServiceUnavailable)
+	values, err := sink.ReadRange("Data!A1:A1", false)
+	if err != nil || firstValue(values) != "value" {
+		t.Fatalf("got %v, %v", values, err)
+	}
+	if len(fake.sleeps) != 2 || fake.sleeps[0] != 90*time.Second {
+		t.Errorf("slept %v, want twice for 90s", fake.sleeps)
+	}
+
+	// Client errors are not retried
+	fake.failNext(http.MethodPut, 1, http.StatusBadRequest)
+	if err := sink.WriteRange("Data!A1:A1", [][]interface{}{{"new"}}); err == nil {
+		t.Error("expected the bad request to fail")
+	}
+	if got := fake.count(http.MethodPut); got != 1 {
+		t.Errorf("got %d writes, want 1", got)
+	}
+
+	// Attempts run out
+	fake.failNext(http.MethodPost, 10, http.StatusTooManyRequests)
+	if err := sink.BatchWrite([]CellRange{{Range: "Data!A1:A1", Values: [][]interface{}{{"new"}}}}); err == nil {
+		t.Error("expected the batch write to give up")
+	}
+	if got := fake.count(http.MethodPost); got != defaultRetryPolicy().MaxAttempts {
+		t.Errorf("got %d batch writes, want %d", got, defaultRetryPolicy().MaxAttempts)
+	}
+}
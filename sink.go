@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/takuoki/clmconv"
+	sheets "google.golang.org/api/sheets/v4"
+)
+
+// CellRange holds the values to set in a cell range given in A1 notation,
+// i.e "KPI data!C7:C7"
+type CellRange struct {
+	Range  string
+	Values [][]interface{}
+}
+
+// Dimension is the direction of a line of cells in a sheet
+type Dimension int
+
+const (
+	// Rows are the horizontal lines, i.e 7
+	Rows Dimension = iota
+	// Columns are the vertical lines, i.e "C"
+	Columns
+)
+
+// String returns the name of the dimension, for logs and errors
+func (d Dimension) String() string {
+	if d == Rows {
+		return "rows"
+	}
+	return "columns"
+}
+
+// Sink is a destination for KPI data laid out as a sheet with topics
+// (i.e "2020-07") in a topic row and keys (i.e KPI titles) in a key column.
+type Sink interface {
+	// ReadRange returns the values in a cell range, optionally unformatted
+	ReadRange(cellRange string, unformatted bool) ([][]interface{}, error)
+	// WriteRange sets the values in a cell range
+	WriteRange(cellRange string, values [][]interface{}) error
+	// BatchRead returns the values of several cell ranges at once, in the
+	// order of the ranges
+	BatchRead(cellRanges []string, unformatted bool) ([][][]interface{}, error)
+	// BatchWrite sets the values of several cell ranges at once
+	BatchWrite(ranges []CellRange) error
+	// LookupTopic returns all cells in the topic row of a sheet
+	LookupTopic(sheetName, topicRow string) ([]interface{}, error)
+	// LookupKey returns the cells of a key column, starting at dataStartRow.
+	// Each row holds one cell, empty cells are returned as empty rows.
+	LookupKey(sheetName, keyCol string, dataStartRow int) ([][]interface{}, error)
+	// InsertDimension inserts an empty row or column at a zero based index
+	// of a sheet. Unless copyFrom is negative, the formats and formulas of
+	// the line at copyFrom, as indexed before the insert, are copied into it.
+	InsertDimension(sheetName string, dimension Dimension, index, copyFrom int) error
+	// DeleteDimension deletes the row or column at a zero based index of a
+	// sheet
+	DeleteDimension(sheetName string, dimension Dimension, index int) error
+	// Ping checks that the destination is reachable with our credentials
+	Ping() error
+}
+
+// googleSheetSink is a Sink writing to a Google spreadsheet, retrying
+// failed calls according to its retry policy. Every call, including
+// retries, waits for the rate limiter of its quota group.
+type googleSheetSink struct {
+	srv           *sheets.Service
+	spreadsheetID string
+	retry         retryPolicy
+	limiter       *sheetsLimiter
+}
+
+func newGoogleSheetSink(srv *sheets.Service, spreadsheetID string,
+	retry retryPolicy, limiter *sheetsLimiter) *googleSheetSink {
+	return &googleSheetSink{srv: srv, spreadsheetID: spreadsheetID, retry: retry, limiter: limiter}
+}
+
+func (g *googleSheetSink) ReadRange(cellRange string, unformatted bool) ([][]interface{}, error) {
+	call := g.srv.Spreadsheets.Values.Get(g.spreadsheetID, cellRange)
+	if unformatted {
+		call = call.ValueRenderOption("UNFORMATTED_VALUE")
+	}
+	var resp *sheets.ValueRange
+	err := g.retry.do("read "+cellRange, func() (err error) {
+		g.limiter.read.wait()
+		resp, err = call.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Values, nil
+}
+
+func (g *googleSheetSink) WriteRange(cellRange string, values [][]interface{}) error {
+	vr := sheets.ValueRange{Values: values}
+	call := g.srv.Spreadsheets.Values.Update(g.spreadsheetID,
+		cellRange, &vr).ValueInputOption("USER_ENTERED")
+	return g.retry.do("write "+cellRange, func() error {
+		g.limiter.write.wait()
+		_, err := call.Do()
+		return err
+	})
+}
+
+func (g *googleSheetSink) BatchRead(cellRanges []string, unformatted bool) ([][][]interface{}, error) {
+	if len(cellRanges) == 0 {
+		return nil, nil
+	}
+	call := g.srv.Spreadsheets.Values.BatchGet(g.spreadsheetID).Ranges(cellRanges...)
+	if unformatted {
+		call = call.ValueRenderOption("UNFORMATTED_VALUE")
+	}
+	var resp *sheets.BatchGetValuesResponse
+	err := g.retry.do(fmt.Sprintf("batch read %d ranges", len(cellRanges)), func() (err error) {
+		g.limiter.read.wait()
+		resp, err = call.Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	values := make([][][]interface{}, len(cellRanges))
+	for i, vr := range resp.ValueRanges {
+		if i < len(values) {
+			values[i] = vr.Values
+		}
+	}
+	return values, nil
+}
+
+func (g *googleSheetSink) BatchWrite(ranges []CellRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	req := sheets.BatchUpdateValuesRequest{ValueInputOption: "USER_ENTERED"}
+	for _, r := range ranges {
+		req.Data = append(req.Data, &sheets.ValueRange{Range: r.Range, Values: r.Values})
+	}
+	call := g.srv.Spreadsheets.Values.BatchUpdate(g.spreadsheetID, &req)
+	return g.retry.do(fmt.Sprintf("batch write %d ranges", len(ranges)), func() error {
+		g.limiter.write.wait()
+		_, err := call.Do()
+		return err
+	})
+}
+
+func (g *googleSheetSink) LookupTopic(sheetName, topicRow string) ([]interface{}, error) {
+	values, err := g.ReadRange(sheetName+"!"+"A"+topicRow+":"+topicRow, false)
+	if err != nil || len(values) == 0 {
+		return nil, err
+	}
+	return values[0], nil
+}
+
+func (g *googleSheetSink) LookupKey(sheetName, keyCol string, dataStartRow int) ([][]interface{}, error) {
+	return g.ReadRange(sheetName+"!"+keyCol+
+		fmt.Sprintf("%d", dataStartRow)+":"+keyCol, false)
+}
+
+func (g *googleSheetSink) InsertDimension(sheetName string, dimension Dimension, index, copyFrom int) error {
+	sheetID, err := g.sheetID(sheetName)
+	if err != nil {
+		return err
+	}
+
+	// gridRange returns the line at a zero based index, over the whole sheet
+	gridRange := func(i int) *sheets.GridRange {
+		if dimension == Rows {
+			return &sheets.GridRange{SheetId: sheetID, StartRowIndex: int64(i), EndRowIndex: int64(i + 1)}
+		}
+		return &sheets.GridRange{SheetId: sheetID, StartColumnIndex: int64(i), EndColumnIndex: int64(i + 1)}
+	}
+	req := sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{{
+		InsertDimension: &sheets.InsertDimensionRequest{
+			Range: &sheets.DimensionRange{
+				SheetId:    sheetID,
+				Dimension:  sheetsDimension(dimension),
+				StartIndex: int64(index),
+				EndIndex:   int64(index + 1),
+			},
+			InheritFromBefore: index > 0,
+		},
+	}}}
+	if copyFrom >= 0 {
+		if copyFrom >= index {
+			copyFrom++ // Moved by the insert
+		}
+		for _, pasteType := range []string{"PASTE_FORMAT", "PASTE_FORMULA"} {
+			req.Requests = append(req.Requests, &sheets.Request{CopyPaste: &sheets.CopyPasteRequest{
+				Source:      gridRange(copyFrom),
+				Destination: gridRange(index),
+				PasteType:   pasteType,
+			}})
+		}
+	}
+	call := g.srv.Spreadsheets.BatchUpdate(g.spreadsheetID, &req)
+	err = g.retry.do("insert "+dimension.String(), func() error {
+		g.limiter.write.wait()
+		_, err := call.Do()
+		return err
+	})
+	if err != nil || copyFrom < 0 {
+		return err
+	}
+
+	// Pasting formulas also pastes plain values, which belong to the line
+	// copied from, so clear them
+	line := clmconv.Itoa(index) + ":" + clmconv.Itoa(index)
+	if dimension == Rows {
+		line = fmt.Sprintf("%d:%d", index+1, index+1)
+	}
+	formulas := g.srv.Spreadsheets.Values.Get(g.spreadsheetID, sheetName+"!"+line).
+		ValueRenderOption("FORMULA").MajorDimension(sheetsDimension(dimension))
+	var resp *sheets.ValueRange
+	err = g.retry.do("read formulas "+line, func() (err error) {
+		g.limiter.read.wait()
+		resp, err = formulas.Do()
+		return err
+	})
+	if err != nil || len(resp.Values) == 0 {
+		return err
+	}
+	var clear []CellRange
+	for i, v := range resp.Values[0] {
+		if s := fmt.Sprintf("%v", v); s == "" || strings.HasPrefix(s, "=") {
+			continue
+		}
+		cell := clmconv.Itoa(index) + fmt.Sprintf("%d", i+1)
+		if dimension == Rows {
+			cell = clmconv.Itoa(i) + fmt.Sprintf("%d", index+1)
+		}
+		clear = append(clear, CellRange{Range: sheetName + "!" + cell, Values: [][]interface{}{{""}}})
+	}
+	return g.BatchWrite(clear)
+}
+
+func (g *googleSheetSink) DeleteDimension(sheetName string, dimension Dimension, index int) error {
+	sheetID, err := g.sheetID(sheetName)
+	if err != nil {
+		return err
+	}
+	req := sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{{
+		DeleteDimension: &sheets.DeleteDimensionRequest{
+			Range: &sheets.DimensionRange{
+				SheetId:    sheetID,
+				Dimension:  sheetsDimension(dimension),
+				StartIndex: int64(index),
+				EndIndex:   int64(index + 1),
+			},
+		},
+	}}}
+	call := g.srv.Spreadsheets.BatchUpdate(g.spreadsheetID, &req)
+	return g.retry.do("delete "+dimension.String(), func() error {
+		g.limiter.write.wait()
+		_, err := call.Do()
+		return err
+	})
+}
+
+// sheetsDimension returns the Sheets API name of a dimension
+func sheetsDimension(d Dimension) string {
+	if d == Rows {
+		return "ROWS"
+	}
+	return "COLUMNS"
+}
+
+// sheetID returns the numeric ID of a sheet, as used by spreadsheet updates
+func (g *googleSheetSink) sheetID(sheetName string) (int64, error) {
+	call := g.srv.Spreadsheets.Get(g.spreadsheetID).Fields("sheets.properties(sheetId,title)")
+	var resp *sheets.Spreadsheet
+	err := g.retry.do("read sheet properties", func() (err error) {
+		g.limiter.read.wait()
+		resp, err = call.Do()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, sheet := range resp.Sheets {
+		if sheet.Properties != nil && sheet.Properties.Title == sheetName {
+			return sheet.Properties.SheetId, nil
+		}
+	}
+	return 0, fmt.Errorf("no sheet named %q", sheetName)
+}
+
+func (g *googleSheetSink) Ping() error {
+	call := g.srv.Spreadsheets.Get(g.spreadsheetID).Fields("spreadsheetId")
+	return g.retry.do("ping", func() error {
+		g.limiter.read.wait()
+		_, err := call.Do()
+		return err
+	})
+}
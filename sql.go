@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	// Database drivers for SQL sources
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// defaultSQLTimeout limits a query of an SQL source
+const defaultSQLTimeout = 30 * time.Second
+
+// sqlDrivers are the database drivers an SQL source can use
+var sqlDrivers = map[string]bool{"postgres": true, "mysql": true, "sqlite3": true}
+
+// SQLQuery is a query against a reporting database, as the source of a
+// KPI or datapoint
+type SQLQuery struct {
+	Driver  string `yaml:"driver"`  // "postgres", "mysql" or "sqlite3"
+	DSN     string `yaml:"dsn"`     // Can use ${VAR} and ${file:/path} for secrets
+	Query   string `yaml:"query"`   // Can use the period templates
+	Timeout string `yaml:"timeout"` // Default "30s"
+}
+
+// validate checks the SQL source
+func (q *SQLQuery) validate() error {
+	if !sqlDrivers[q.Driver] {
+		return fmt.Errorf("sql driver %q is not postgres, mysql or sqlite3", q.Driver)
+	}
+	if q.DSN == "" {
+		return fmt.Errorf("sql has no dsn")
+	}
+	if q.Query == "" {
+		return fmt.Errorf("sql has no query")
+	}
+	if q.Timeout != "" {
+		if d, err := time.ParseDuration(q.Timeout); err != nil || d <= 0 {
+			return fmt.Errorf("sql timeout %q is not a positive duration", q.Timeout)
+		}
+	}
+	return nil
+}
+
+// value runs the query for a KPI, which has to give a single value
+func (q *SQLQuery) value(window periodWindow) (string, error) {
+	names, rows, err := q.run(window)
+	if err != nil {
+		return "", err
+	}
+	if len(rows) != 1 || len(names) != 1 {
+		return "", fmt.Errorf("sql query gave %d row(s) of %d column(s), want a single row with a single column", len(rows), len(names))
+	}
+	return rows[0][0], nil
+}
+
+// lines runs the query for a datapoint, which gives the key columns and
+// one or more value columns, and returns them as JSON lines, as a datapoint
+// command would. The first column is "key", the first value after the keys
+// is "val", and each column is also in a field named by the column, for
+// key-fields and datapoint columns.
+func (q *SQLQuery) lines(window periodWindow, keys int) (string, error) {
+	names, rows, err := q.run(window)
+	if err != nil {
+		return "", err
+	}
+	var out strings.Builder
+	for _, row := range rows {
+		if len(row) <= keys {
+			return "", fmt.Errorf("sql query gave %d columns, want %d key column(s) and a value", len(row), keys)
+		}
+		fields := make(map[string]string)
+		for i := range row {
+			fields[names[i]] = row[i]
+		}
+		fields["key"], fields["val"] = row[0], row[keys]
+		line, _ := json.Marshal(fields)
+		out.Write(line)
+		out.WriteString("\n")
+	}
+	return out.String(), nil
+}
+
+// run connects to the database and returns the column names, and the rows
+// of the query as text
+func (q *SQLQuery) run(window periodWindow) ([]string, [][]string, error) {
+	dsn, err := expandSecrets(q.DSN)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open(q.Driver, dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening %s database: %w", q.Driver, err)
+	}
+	defer func() { _ = db.Close() }()
+
+	timeout := defaultSQLTimeout
+	if q.Timeout != "" {
+		timeout, _ = time.ParseDuration(q.Timeout) // Checked by validate
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, window.expand(q.Query, func(s string) string { return s }))
+	if err != nil {
+		return nil, nil, fmt.Errorf("sql query: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result [][]string
+	for rows.Next() {
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, nil, fmt.Errorf("sql query: %w", err)
+		}
+		row := make([]string, len(columns))
+		for i, v := range values {
+			if row[i], err = sqlText(v); err != nil {
+				return nil, nil, fmt.Errorf("sql column %s: %w", columns[i], err)
+			}
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("sql query: %w", err)
+	}
+	return columns, result, nil
+}
+
+// sqlText returns a scanned column value as text
+func sqlText(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", fmt.Errorf("value is NULL")
+	case []byte:
+		return string(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	}
+	return fmt.Sprintf("%v", v), nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testDatabase creates an SQLite database with the statements, and
+// returns its DSN and a func removing it
+func testDatabase(t *testing.T, statements ...string) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kpi-uploader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn := filepath.Join(dir, "reports.db")
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	return dsn, func() { os.RemoveAll(dir) }
+}
+
+func TestSQLQueryValue(t *testing.T) {
+	dsn, cleanup := testDatabase(t,
+		"CREATE TABLE migrations (app TEXT, migrated TEXT, replicas INTEGER)",
+		"INSERT INTO migrations VALUES ('app1', '2020-02-11T12:00:00Z', 3), ('app2', '2020-02-20T12:00:00Z', 5), ('app3', NULL, 1)")
+	defer cleanup()
+
+	os.Setenv("SQL_TEST_DSN", dsn)
+	defer os.Unsetenv("SQL_TEST_DSN")
+
+	for query, want := range map[string]string{
+		"SELECT count(*) FROM migrations WHERE migrated < '{period-end}'": "1",
+		"SELECT avg(replicas) FROM migrations":                            "3",
+		"SELECT sum(replicas) / 2.0 FROM migrations":                      "4.5",
+		"SELECT '{period}'": "2020-07",
+	} {
+		q := &SQLQuery{Driver: "sqlite3", DSN: "${SQL_TEST_DSN}", Query: query}
+		got, err := q.value(testWindow())
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+		} else if got != want {
+			t.Errorf("%s = %q, want %q", query, got, want)
+		}
+	}
+
+	for query, want := range map[string]string{
+		"SELECT app FROM migrations":                         "3 row(s) of 1 column(s)",
+		"SELECT app, replicas FROM migrations LIMIT 1":       "1 row(s) of 2 column(s)",
+		"SELECT migrated FROM migrations WHERE app = 'app3'": "NULL",
+		"SELECT missing FROM migrations":                     "no such column",
+	} {
+		q := &SQLQuery{Driver: "sqlite3", DSN: dsn, Query: query}
+		if _, err := q.value(testWindow()); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s gave %v, want %q", query, err, want)
+		}
+	}
+}
+
+func TestUpdateGoogleSheetValuesSQL(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	dsn, cleanup := testDatabase(t,
+		"CREATE TABLE deployments (app TEXT, replicas INTEGER)",
+		"INSERT INTO deployments VALUES ('app1', 2), ('app1', 4), ('app2', 6)")
+	defer cleanup()
+
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{{
+		Title: "maxReplica",
+		SQL:   &SQLQuery{Driver: "sqlite3", DSN: dsn, Query: "SELECT app, max(replicas) FROM deployments GROUP BY app"},
+	}}
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica"},
+		[]interface{}{"app1"},
+		[]interface{}{"app2"})
+
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{"B2": 4.0, "B3": 6.0} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestSQLQueryLines(t *testing.T) {
+	dsn, cleanup := testDatabase(t,
+		"CREATE TABLE deployments (app TEXT, cpu REAL, replicas INTEGER)",
+		"INSERT INTO deployments VALUES ('app1', 0.5, 2)")
+	defer cleanup()
+
+	q := &SQLQuery{Driver: "sqlite3", DSN: dsn, Query: "SELECT app, cpu, replicas FROM deployments"}
+	lines, err := q.lines(testWindow(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"app":"app1","cpu":"0.5","key":"app1","replicas":"2","val":"0.5"}` + "\n"; lines != want {
+		t.Errorf("lines = %q, want %q", lines, want)
+	}
+	if _, err := q.lines(testWindow(), 3); err == nil {
+		t.Error("query without a value after the keys did not fail")
+	}
+}
+
+func TestUpdateGoogleSheetValuesSQLCompositeKeys(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	dsn, cleanup := testDatabase(t,
+		"CREATE TABLE deployments (cluster TEXT, app TEXT, replicas INTEGER)",
+		"INSERT INTO deployments VALUES ('prod', 'web', 3), ('dev', 'web', 1), ('prod', 'api', 5)")
+	defer cleanup()
+
+	cfg := datapointTestConfig()
+	cfg.Datapoints = []Datapoint{{
+		Title:     "maxReplica",
+		SQL:       &SQLQuery{Driver: "sqlite3", DSN: dsn, Query: "SELECT cluster, app, max(replicas) FROM deployments GROUP BY cluster, app"},
+		KeyCols:   []string{"A", "B"},
+		KeyFields: []string{"cluster", "app"},
+	}}
+	fake.set("Deployments", "A1",
+		[]interface{}{"cluster", "app", "maxReplica"},
+		[]interface{}{"prod", "web"},
+		[]interface{}{"dev", "web"},
+		[]interface{}{"prod", "api"})
+
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{"C2": 3.0, "C3": 1.0, "C4": 5.0} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestSQLQueryValidate(t *testing.T) {
+	for _, test := range []struct {
+		q    SQLQuery
+		want string
+	}{
+		{SQLQuery{Driver: "oracle", DSN: "x", Query: "SELECT 1"}, "driver"},
+		{SQLQuery{Driver: "postgres", Query: "SELECT 1"}, "dsn"},
+		{SQLQuery{Driver: "mysql", DSN: "x"}, "query"},
+		{SQLQuery{Driver: "sqlite3", DSN: "x", Query: "SELECT 1", Timeout: "long"}, "timeout"},
+	} {
+		if err := test.q.validate(); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("validate %+v = %v, want %q", test.q, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stalePolicies are the ways to handle the rows of keys missing from the
+// scrape of a datapoint
+var stalePolicies = map[string]bool{"keep": true, "clear": true, "mark": true, "delete": true, "archive": true}
+
+// defaultStaleMarker is the text stale-policy "mark" sets
+const defaultStaleMarker = "stale"
+
+// staleRow is the row of a key missing from the scrape of a datapoint
+type staleRow struct {
+	Title        string // Of the datapoint
+	Policy       string
+	ArchiveSheet string
+	KeyCol       string
+	Key          string
+	Row          int
+}
+
+// validateStalePolicy checks the stale policy of the datapoint
+func (dp *Datapoint) validateStalePolicy(cfg *Config) error {
+	if dp.StalePolicy != "" && !stalePolicies[dp.StalePolicy] {
+		return fmt.Errorf("stale-policy %q is not keep, clear, mark, delete or archive", dp.StalePolicy)
+	}
+	if dp.StaleMarker != "" && dp.StalePolicy != "mark" {
+		return fmt.Errorf("stale-marker is only used with stale-policy mark")
+	}
+	if (dp.StalePolicy == "archive") != (dp.ArchiveSheet != "") {
+		return fmt.Errorf("stale-policy archive needs an archive-sheet, and archive-sheet needs stale-policy archive")
+	}
+	if dp.ArchiveSheet != "" && dp.ArchiveSheet == cfg.SheetName {
+		return fmt.Errorf("archive-sheet %q is the sheet of the datapoint", dp.ArchiveSheet)
+	}
+	return nil
+}
+
+// staleValue returns the value stale cells are set to, and if the policy
+// sets cells at all
+func (dp *Datapoint) staleValue() (string, bool) {
+	switch dp.StalePolicy {
+	case "clear":
+		return "", true
+	case "mark":
+		if dp.StaleMarker == "" {
+			return defaultStaleMarker, true
+		}
+		return dp.StaleMarker, true
+	}
+	return "", false
+}
+
+// findStaleRows returns the rows of the cached keys, those of the key columns
+// of the datapoint, which are not in the records or matched by them, sorted
+// by row. Without records no row is stale, as an empty scrape more likely is
+// a broken command than all the keys gone.
+func findStaleRows(dp *Datapoint, keyCol string, records []datapointRecord, matchedRows map[int]bool) []staleRow {
+	if dp.StalePolicy == "" || dp.StalePolicy == "keep" {
+		return nil
+	}
+	if len(records) == 0 {
+		logit.WithFields(log.Fields{
+			"kpi": dp.Title,
+		}).Warning("No keys in the scrape, not handling stale rows")
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, record := range records {
+		seen[record.Key] = true
+	}
+	var stale []staleRow
+	add := func(key string, row int) {
+		if matchedRows[row] {
+			return
+		}
+		stale = append(stale, staleRow{Title: dp.Title, Policy: dp.StalePolicy,
+			ArchiveSheet: dp.ArchiveSheet, KeyCol: keyCol, Key: key, Row: row})
+	}
+	for key, row := range keyCache {
+		if seen[key] || key == "" {
+			continue
+		}
+		if dp.MatchAll != "yes" {
+			add(key, row)
+			continue
+		}
+		rows := map[int]bool{row: true}
+		for _, row := range keyCacheArr[key] {
+			rows[row] = true
+		}
+		for row := range rows {
+			add(key, row)
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Row < stale[j].Row })
+	return stale
+}
+
+// removeStaleRows deletes the stale rows of the datapoints with stale-policy
+// delete or archive, after copying them to the archive sheet for archive.
+// Rows of keys in the scrape of any datapoint are kept, and so are the rows
+// of the failed datapoints, to which errors are added. Rows are deleted from
+// the bottom up, keeping the numbers of the rows still to delete.
+func removeStaleRows(cfg *Config, sink Sink, plan *syncPlan, stale []staleRow, seenRows map[int]bool, failed map[string]error) {
+	rows := make(map[int]staleRow)
+	for _, s := range stale {
+		if _, ok := rows[s.Row]; ok || seenRows[s.Row] || failed[s.Title] != nil {
+			continue
+		}
+		rows[s.Row] = s
+	}
+	var order []int
+	for row := range rows {
+		order = append(order, row)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(order)))
+
+	for _, row := range order {
+		s := rows[row]
+		logit.WithFields(log.Fields{
+			"kpi":    s.Title,
+			"key":    s.Key,
+			"row":    s.Row,
+			"policy": s.Policy,
+		}).Info("Removing stale row")
+
+		keyCell := fmt.Sprintf("%s!%s%d", cfg.SheetName, s.KeyCol, s.Row)
+		if cfg.DryRun == "yes" {
+			removed := "(row deleted)"
+			if s.Policy == "archive" {
+				removed = "(row moved to " + s.ArchiveSheet + ")"
+			}
+			plan.add(s.Title, keyCell, s.Key, removed)
+			continue
+		}
+		if s.Policy == "archive" {
+			if err := archiveRow(cfg, sink, s); err != nil {
+				failed[s.Title] = err
+				continue
+			}
+		}
+		if err := sink.DeleteDimension(cfg.SheetName, Rows, s.Row-1); err != nil {
+			failed[s.Title] = fmt.Errorf("delete stale row %d of key %q: %w", s.Row, s.Key, err)
+		}
+	}
+}
+
+// archiveRow copies the values of a stale row below the last key of the
+// archive sheet, unformatted, and the results rather than the formulas, as
+// these would refer to other rows there
+func archiveRow(cfg *Config, sink Sink, s staleRow) error {
+	values, err := sink.ReadRange(fmt.Sprintf("%s!A%d:%d", cfg.SheetName, s.Row, s.Row), true)
+	if err != nil {
+		return fmt.Errorf("read stale row %d of key %q: %w", s.Row, s.Key, err)
+	}
+	keys, err := sink.LookupKey(s.ArchiveSheet, s.KeyCol, 1)
+	if err != nil {
+		return fmt.Errorf("read key column of archive sheet %s: %w", s.ArchiveSheet, err)
+	}
+	cell := fmt.Sprintf("%s!A%d", s.ArchiveSheet, len(keys)+1)
+	if err := sink.WriteRange(cell, values); err != nil {
+		return fmt.Errorf("archive stale row %d of key %q to %s: %w", s.Row, s.Key, cell, err)
+	}
+	return nil
+}
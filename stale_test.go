@@ -0,0 +1,144 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUpdateGoogleSheetValuesStalePolicy(t *testing.T) {
+	for _, test := range []struct {
+		policy, marker string
+		want           map[string]interface{}
+	}{
+		{"keep", "", map[string]interface{}{"A3": "app3", "B3": 7.0, "A4": "app2", "B4": 5.0}},
+		{"clear", "", map[string]interface{}{"A3": "app3", "B3": nil, "A4": "app2", "B4": 5.0}},
+		{"mark", "gone", map[string]interface{}{"A3": "app3", "B3": "gone", "A4": "app2", "B4": 5.0}},
+		{"delete", "", map[string]interface{}{"A3": "app2", "B3": 5.0, "A4": nil, "B4": nil}},
+	} {
+		fake := newFakeSheets(t)
+		fake.set("Deployments", "A1",
+			[]interface{}{"app", "maxReplica"},
+			[]interface{}{"app1", 1.0},
+			[]interface{}{"app3", 7.0},
+			[]interface{}{"app2", 4.0})
+		cfg := datapointTestConfig()
+		cfg.Datapoints[0].StalePolicy = test.policy
+		cfg.Datapoints[0].StaleMarker = test.marker
+
+		if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+			t.Errorf("%s: run failed: %v", test.policy, summary.Errors)
+		}
+		for cell, want := range test.want {
+			if got := fake.get("Deployments", cell); got != want {
+				t.Errorf("%s: cell %s = %v, want %v", test.policy, cell, got, want)
+			}
+		}
+		fake.Close()
+	}
+}
+
+func TestUpdateGoogleSheetValuesArchiveStaleRows(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "maxReplica", "cpuRequest"},
+		[]interface{}{"app4", 9.0, 1.0},
+		[]interface{}{"app1", 1.0},
+		[]interface{}{"app3", 7.0, 2.0},
+		[]interface{}{"app2", 4.0})
+	fake.setFormula("Deployments", "D4", "=B4*C4", 14.0)
+	fake.set("Archive", "A1", []interface{}{"app", "maxReplica", "cpuRequest"})
+	cfg := datapointTestConfig()
+	cfg.Datapoints[0].StalePolicy = "archive"
+	cfg.Datapoints[0].ArchiveSheet = "Archive"
+
+	// A dry run only plans the moves
+	cfg.DryRun = "yes"
+	summary := updateGoogleSheetValues(cfg, fake.sink())
+	if got := fake.count(http.MethodPost); got != 0 {
+		t.Errorf("got %d writes in a dry run", got)
+	}
+	var cells []string
+	for _, c := range summary.Plan.Changes {
+		if strings.HasPrefix(c.New.(string), "(row moved") {
+			cells = append(cells, c.Cell)
+		}
+	}
+	if got, want := strings.Join(cells, " "), "Deployments!A4 Deployments!A2"; got != want {
+		t.Errorf("planned moves %q, want %q", got, want)
+	}
+
+	cfg.DryRun = ""
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	if got := fake.cell("Archive", "D2"); got.value != 14.0 || got.formula != "" {
+		t.Errorf("cell Archive!D2 = %+v, want the value of the formula", got)
+	}
+	for cell, want := range map[string]interface{}{
+		"Deployments!A2": "app1",
+		"Deployments!B2": 3.0,
+		"Deployments!A3": "app2",
+		"Deployments!B3": 5.0,
+		"Deployments!A4": nil,
+		"Archive!A2":     "app3",
+		"Archive!C2":     2.0,
+		"Archive!A3":     "app4",
+		"Archive!B3":     9.0,
+	} {
+		parts := strings.SplitN(cell, "!", 2)
+		if got := fake.get(parts[0], parts[1]); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
+
+func TestFindStaleRowsWithoutRecords(t *testing.T) {
+	keyCache = map[string]int{"app1": 2, "app2": 3}
+	keyCacheArr = map[string][]int{}
+	dp := &Datapoint{Title: "maxReplica", StalePolicy: "delete"}
+	if stale := findStaleRows(dp, "A", nil, nil); len(stale) != 0 {
+		t.Errorf("empty scrape gave stale rows %+v", stale)
+	}
+	stale := findStaleRows(dp, "A", []datapointRecord{{Key: "app1"}}, map[int]bool{2: true})
+	if len(stale) != 1 || stale[0].Key != "app2" || stale[0].Row != 3 {
+		t.Errorf("stale rows %+v, want app2 in row 3", stale)
+	}
+}
+
+func TestUpdateGoogleSheetValuesStaleKeyCols(t *testing.T) {
+	fake := newFakeSheets(t)
+	defer fake.Close()
+
+	fake.set("Deployments", "A1",
+		[]interface{}{"app", "owner", "maxReplica", "services"},
+		[]interface{}{"app1", "team-a"},
+		[]interface{}{"app2", "team-b"},
+		[]interface{}{"app3", "team-c", 7.0, 9.0},
+		[]interface{}{"app4", "", 1.0})
+	cfg := datapointTestConfig()
+	cfg.Datapoints[0].StalePolicy = "mark"
+	cfg.Datapoints = append(cfg.Datapoints, Datapoint{
+		Title:       "services",
+		Command:     "cat",
+		Args:        "testdata/owners.jsonl",
+		KeyCol:      "B",
+		StalePolicy: "mark",
+	})
+
+	// The keys of column A are not stale keys of the datapoint on column B
+	if summary := updateGoogleSheetValues(cfg, fake.sink()); summary.Failed() {
+		t.Fatalf("run failed: %v", summary.Errors)
+	}
+	for cell, want := range map[string]interface{}{
+		"C2": 3.0, "C3": 5.0, "C4": "stale",
+		"D2": 2.0, "D3": 4.0, "D4": "stale",
+		"C5": "stale", "D5": nil,
+	} {
+		if got := fake.get("Deployments", cell); got != want {
+			t.Errorf("cell %s = %v, want %v", cell, got, want)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runSummary collects the outcome of a sync run per KPI or datapoint title
+type runSummary struct {
+	Synced  []string
+	Skipped []string
+	Errors  map[string][]error // Errors per title, in the order they happened
+	Err     error              // Error aborting the whole run
+	Plan    syncPlan           // Cell changes of a dry run
+
+	NearMisses []nearMiss // Keys not in the sheet, with similar sheet keys
+
+	failedTitles []string
+}
+
+// nearMiss is a key not in the sheet, and the sheet keys it likely was
+// meant to match
+type nearMiss struct {
+	Title     string
+	Key       string
+	SheetKeys []string
+}
+
+func newRunSummary() *runSummary {
+	return &runSummary{Errors: make(map[string][]error)}
+}
+
+// synced records a title as successfully synced
+func (s *runSummary) synced(title string) {
+	s.Synced = append(s.Synced, title)
+}
+
+// skipped records a title that had nothing to sync
+func (s *runSummary) skipped(title string) {
+	s.Skipped = append(s.Skipped, title)
+}
+
+// failed records an error for a title
+func (s *runSummary) failed(title string, err error) {
+	logit.WithFields(log.Fields{
+		"kpi":   title,
+		"error": err,
+	}).Error("Sync failed")
+
+	if _, ok := s.Errors[title]; !ok {
+		s.failedTitles = append(s.failedTitles, title)
+	}
+	s.Errors[title] = append(s.Errors[title], err)
+}
+
+// nearMiss records a key not in the sheet, with similar sheet keys
+func (s *runSummary) nearMiss(title, key string, sheetKeys []string) {
+	logit.WithFields(log.Fields{
+		"kpi":        title,
+		"key":        key,
+		"sheet-keys": quoteKeys(sheetKeys),
+	}).Warning("Key not in the sheet, but near sheet keys")
+
+	s.NearMisses = append(s.NearMisses, nearMiss{Title: title, Key: key, SheetKeys: sheetKeys})
+}
+
+// printNearMisses writes the keys not in the sheet with similar sheet keys,
+// if there are any
+func (s *runSummary) printNearMisses(w io.Writer) {
+	if len(s.NearMisses) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "KPI\tKEY NOT IN SHEET\tNEAR SHEET KEYS")
+	for _, m := range s.NearMisses {
+		_, _ = fmt.Fprintf(tw, "%s\t%q\t%s\n", m.Title, m.Key, quoteKeys(m.SheetKeys))
+	}
+	_ = tw.Flush()
+}
+
+// quoteKeys returns keys quoted and comma separated
+func quoteKeys(keys []string) string {
+	quoted := make([]string, len(keys))
+	for i, key := range keys {
+		quoted[i] = strconv.Quote(key)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// abort records an error stopping the whole run
+func (s *runSummary) abort(err error) {
+	logit.WithFields(log.Fields{
+		"error": err,
+	}).Error("Sync aborted")
+
+	s.Err = err
+}
+
+// Failed tells if anything went wrong during the run
+func (s *runSummary) Failed() bool {
+	return s.Err != nil || len(s.Errors) > 0
+}
+
+// log writes the run summary, one line per failed title
+func (s *runSummary) log() {
+	fields := log.Fields{
+		"synced":  len(s.Synced),
+		"skipped": len(s.Skipped),
+		"failed":  len(s.failedTitles),
+	}
+	if s.Err != nil {
+		fields["error"] = s.Err
+	}
+	if len(s.NearMisses) > 0 {
+		fields["near-misses"] = len(s.NearMisses)
+	}
+	if !s.Failed() {
+		logit.WithFields(fields).Info("Run summary")
+		return
+	}
+	logit.WithFields(fields).Error("Run summary")
+
+	for _, title := range s.failedTitles {
+		var msgs []string
+		for _, err := range s.Errors[title] {
+			msgs = append(msgs, err.Error())
+		}
+		logit.WithFields(log.Fields{
+			"kpi":    title,
+			"errors": strings.Join(msgs, "; "),
+		}).Error("Failed")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// KPI values are carried as an int64, a float64 or, for value-type
+// "decimal", a json.Number holding the exact decimal. All of them are
+// written to the sheet as numbers.
+
+// parseKPIValue parses a scraped value as the type of the KPI, rounded to
+// its precision. Without a value type integers are kept as int64 and
+// anything else as float64.
+func parseKPIValue(text string, kpi *KPIs) (interface{}, error) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no value in %q", text)
+	}
+	text = fields[0] // The result number, as the first word
+
+	r, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return nil, fmt.Errorf("value %q is not a number", text)
+	}
+	if kpi.Precision != "" || kpi.ValueType == "int" {
+		precision := 0
+		if kpi.ValueType != "int" {
+			precision, _ = strconv.Atoi(kpi.Precision) // Checked by validateKPIValue
+		}
+		r = roundRat(r, precision, kpi.Rounding)
+		if kpi.ValueType == "decimal" {
+			text = r.FloatString(precision)
+		}
+	}
+
+	switch kpi.ValueType {
+	case "int":
+		if !r.Num().IsInt64() {
+			return nil, fmt.Errorf("value %q is out of range for an int", text)
+		}
+		return r.Num().Int64(), nil
+	case "decimal":
+		return json.Number(text), nil
+	case "float":
+		f, _ := r.Float64()
+		return f, nil
+	}
+	if r.IsInt() && r.Num().IsInt64() {
+		return r.Num().Int64(), nil
+	}
+	f, _ := r.Float64()
+	return f, nil
+}
+
+// roundRat rounds r to precision decimals. The rounding is "half-up"
+// (away from zero) by default, "half-even", "down" (towards zero) or "up"
+// (away from zero).
+func roundRat(r *big.Rat, precision int, rounding string) *big.Rat {
+	scale := new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(precision)), nil))
+	scaled := new(big.Rat).Mul(r, scale)
+
+	// Truncate towards zero, and see how far past it we were
+	q, m := new(big.Int).QuoRem(scaled.Num(), scaled.Denom(), new(big.Int))
+	if m.Sign() != 0 {
+		half := new(big.Int).Abs(new(big.Int).Lsh(m, 1)).Cmp(scaled.Denom())
+		var away bool
+		switch rounding {
+		case "down":
+			away = false
+		case "up":
+			away = true
+		case "half-even":
+			away = half > 0 || (half == 0 && q.Bit(0) == 1)
+		default:
+			away = half >= 0
+		}
+		if away {
+			q.Add(q, big.NewInt(int64(scaled.Sign())))
+		}
+	}
+	return new(big.Rat).Quo(new(big.Rat).SetInt(q), scale)
+}
+
+// validateKPIValue checks the value-type, precision and rounding of a KPI
+func validateKPIValue(kpi *KPIs) error {
+	switch kpi.ValueType {
+	case "", "int", "float", "decimal":
+	default:
+		return fmt.Errorf("value-type %q is not int, float or decimal", kpi.ValueType)
+	}
+	if kpi.Precision != "" {
+		if p, err := strconv.Atoi(kpi.Precision); err != nil || p < 0 {
+			return fmt.Errorf("precision %q is not a number of decimals", kpi.Precision)
+		}
+	}
+	switch kpi.Rounding {
+	case "", "half-up", "half-even", "down", "up":
+	default:
+		return fmt.Errorf("rounding %q is not half-up, half-even, down or up", kpi.Rounding)
+	}
+	return nil
+}
+
+// valueToFloat returns a KPI value as a float64, i.e for a gauge
+func valueToFloat(v interface{}) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case float64:
+		return n
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	}
+	return 0
+}
+
+// sameValue tells if a cell value is the value we want to set. Numbers
+// are compared by value, as the sheet returns 97.350 as the float 97.35,
+// and anything else as text, with an empty cell as "".
+func sameValue(cell, value interface{}) bool {
+	a, b := fmt.Sprintf("%v", cell), fmt.Sprintf("%v", value)
+	if cell == nil {
+		a = ""
+	}
+	if value == nil {
+		b = ""
+	}
+	if a == b {
+		return true
+	}
+	ra, okA := new(big.Rat).SetString(a)
+	rb, okB := new(big.Rat).SetString(b)
+	if !okA || !okB {
+		return false
+	}
+	if ra.Cmp(rb) == 0 {
+		return true
+	}
+
+	// The sheet stores numbers as doubles, so a decimal or large integer
+	// may come back rounded
+	fa, _ := ra.Float64()
+	fb, _ := rb.Float64()
+	return fa == fb
+}
+
+// ratText returns a computed value as text for parseKPIValue, exact for
+// integers and as the nearest float64 otherwise
+func ratText(r *big.Rat) string {
+	if r.IsInt() {
+		return r.RatString()
+	}
+	f, _ := r.Float64()
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+)
+
+func TestParseKPIValue(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		kpi  KPIs
+		want interface{}
+	}{
+		{"42\n", KPIs{}, int64(42)},
+		{"97.35", KPIs{}, 97.35},
+		{"1e3", KPIs{}, int64(1000)},
+		{"97.0 percent", KPIs{}, int64(97)},
+		{"97.35", KPIs{ValueType: "int"}, int64(97)},
+		{"97.5", KPIs{ValueType: "int"}, int64(98)},
+		{"-97.5", KPIs{ValueType: "int", Rounding: "half-even"}, int64(-98)},
+		{"42", KPIs{ValueType: "float"}, 42.0},
+		{"97.3456", KPIs{Precision: "2"}, 97.35},
+		{"2.675", KPIs{Precision: "2"}, 2.68},
+		{"1234.5678901234567890123", KPIs{ValueType: "decimal"}, json.Number("1234.5678901234567890123")},
+		{"0.125", KPIs{ValueType: "decimal", Precision: "2", Rounding: "half-even"}, json.Number("0.12")},
+		{"0.125", KPIs{ValueType: "decimal", Precision: "4"}, json.Number("0.1250")},
+	} {
+		got, err := parseKPIValue(test.text, &test.kpi)
+		if err != nil {
+			t.Errorf("parseKPIValue(%q, %+v): %v", test.text, test.kpi, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseKPIValue(%q, %+v) = %#v, want %#v", test.text, test.kpi, got, test.want)
+		}
+	}
+
+	for _, text := range []string{"", "  \n", "NaN", "three"} {
+		if got, err := parseKPIValue(text, &KPIs{}); err == nil {
+			t.Errorf("parseKPIValue(%q) = %v, want an error", text, got)
+		}
+	}
+}
+
+func TestRoundRat(t *testing.T) {
+	for _, test := range []struct {
+		value     string
+		precision int
+		rounding  string
+		want      string
+	}{
+		{"1.25", 1, "", "1.3"},
+		{"-1.25", 1, "half-up", "-1.3"},
+		{"1.25", 1, "half-even", "1.2"},
+		{"1.35", 1, "half-even", "1.4"},
+		{"1.29", 1, "down", "1.2"},
+		{"-1.29", 1, "down", "-1.2"},
+		{"1.21", 1, "up", "1.3"},
+		{"1.2", 1, "up", "1.2"},
+		{"1234", 0, "", "1234"},
+	} {
+		r, _ := new(big.Rat).SetString(test.value)
+		if got := roundRat(r, test.precision, test.rounding).FloatString(test.precision); got != test.want {
+			t.Errorf("roundRat(%s, %d, %q) = %s, want %s", test.value, test.precision, test.rounding, got, test.want)
+		}
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	for _, test := range []struct {
+		cell, value interface{}
+		want        bool
+	}{
+		{nil, "", true},
+		{"title", "title", true},
+		{"title", "other", false},
+		{97.35, json.Number("97.350"), true},
+		{42.0, int64(42), true},
+		{1234.56789012345678, json.Number("1234.56789012345678"), true},
+		{42.0, int64(43), false},
+		{"2020-02-13", "2020-02-13", true},
+	} {
+		if got := sameValue(test.cell, test.value); got != test.want {
+			t.Errorf("sameValue(%#v, %#v) = %v, want %v", test.cell, test.value, got, test.want)
+		}
+	}
+}